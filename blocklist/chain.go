@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package blocklist
+
+import "github.com/maxymania/gobase/dataman"
+import "io"
+
+/*
+A chain stores a byte string in the elements returned by Allocate(). Every element
+holds Len bytes of the string after its header; the last element has Next=0.
+*/
+
+func freeAddrs(DM dataman.DataManager, baa []BufAddr) {
+	for _,ba := range baa { DM.Free(ba.Off) }
+}
+
+// Stores data in a newly allocated chain and returns its first element.
+func WriteChain(DM dataman.DataManager, data []byte) (int64,error) {
+	baa,err := Allocate(DM,len(data))
+	if err!=nil { freeAddrs(DM,baa); return 0,err }
+	fl := DM.RollbackFile()
+	var elem [16]byte
+	for i,ba := range baa {
+		n := ba.Len
+		if n>len(data) { n = len(data) }
+		next := int64(0)
+		if i+1<len(baa) { next = baa[i+1].Off }
+		IntP(elem[o_next:]).SetInt64(next)
+		IntP(elem[o_cap:]).SetInt(ba.Len)
+		IntP(elem[o_len:]).SetInt(n)
+		_,err = fl.WriteAt(elem[:],ba.Off)
+		if err==nil { _,err = fl.WriteAt(data[:n],ba.Off+16) }
+		if err!=nil { freeAddrs(DM,baa); return 0,err }
+		data = data[n:]
+	}
+	return baa[0].Off,nil
+}
+
+// Appends the string stored in the chain at off to buf.
+func ReadChain(r io.ReaderAt, off int64, buf []byte) ([]byte,error) {
+	if off==0 { return buf,EIllegalPosition }
+	var elem [16]byte
+	for off!=0 {
+		_,err := r.ReadAt(elem[:],off)
+		if err!=nil { return buf,err }
+		n := IntP(elem[o_len:]).Int()
+		l := len(buf)
+		buf = append(buf,make([]byte,n)...)
+		_,err = r.ReadAt(buf[l:],off+16)
+		if err!=nil { return buf,err }
+		off = IntP(elem[o_next:]).Int64()
+	}
+	return buf,nil
+}
+
+// Frees all elements of the chain at off.
+func FreeChain(DM dataman.DataManager, off int64) error {
+	if off==0 { return EIllegalPosition }
+	fl := DM.RollbackFile()
+	for off!=0 {
+		next,err := GetNext(fl,off)
+		if err!=nil { return err }
+		err = DM.Free(off)
+		if err!=nil { return err }
+		off = next
+	}
+	return nil
+}
@@ -88,20 +88,16 @@ func Allocate(DM dataman.DataManager,n int) (baa []BufAddr,err error) {
 	var off,lng int64
 	for _,size := range sizes {
 		for size<n {
-			off,err = DM.Alloc(int64(size)+16)
-			if err!=nil { return }
-			lng,err = DM.UsableSize(off)
+			off,lng,err = DM.AllocAtLeast(int64(size)+16)
 			if err!=nil { return }
 			baa = append(baa,BufAddr{off,int(lng-16)})
 			n-=int(lng-16)
 		}
 	}
 	{
-		off,err = DM.Alloc(int64(n)+16)
-		if err!=nil { return }
-		lng,err = DM.UsableSize(off)
+		off,lng,err = DM.AllocAtLeast(int64(n)+16)
 		if err!=nil { return }
-		baa = append(baa,BufAddr{off,int(lng)})
+		baa = append(baa,BufAddr{off,int(lng-16)})
 	}
 	return
 }
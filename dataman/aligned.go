@@ -0,0 +1,258 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "github.com/cznic/file"
+import "encoding/binary"
+import "errors"
+
+var EInvalidAlignment = errors.New("Invalid alignment (must be a power of 2)")
+var ENoAlignedTable = errors.New("Alignments above 16 require an AlignedTable")
+
+type Allocator interface{
+	Alloc(size int64) (int64, error)
+	Free(off int64) error
+	UsableSize(off int64) (int64, error)
+}
+
+/*
+A persistent table, that maps the offsets returned by AlignedAlloc() to the underlying
+allocations. The table is kept out of band, so the contents of the blocks are never
+inspected. Its root block is laid out as follows:
+
+	[ Entries:8 | Count:8 ]
+
+Entries points to an array of Count pairs [ Aligned:8 | Raw:8 ]. The table is modified
+through the given file, so it is part of the same transaction as the allocations.
+*/
+type AlignedTable struct{
+	a       Allocator
+	f       file.File
+	root    int64
+	entries int64
+	keys    []int64         // The aligned offsets in array order.
+	raw     map[int64]int64 // aligned -> raw
+	index   map[int64]int   // aligned -> position in keys
+}
+
+// Allocate and Clear the root block of an AlignedTable.
+func NewAlignedRoot(dm DataManager) (int64,error) {
+	off,err := dm.Alloc(16)
+	if err!=nil { return 0,err }
+	_,err = dm.RollbackFile().WriteAt(make([]byte,16),off)
+	if err!=nil { return 0,err }
+	return off,nil
+}
+
+func OpenAlignedTable(a Allocator, f file.File, root int64) (*AlignedTable,error) {
+	t := &AlignedTable{a:a,f:f,root:root}
+	err := t.load()
+	if err!=nil { return nil,err }
+	return t,nil
+}
+// (Re-)reads the table from the file, for example after a Rollback().
+func (t *AlignedTable) load() error {
+	var buf [16]byte
+	_,err := t.f.ReadAt(buf[:],t.root)
+	if err!=nil { return err }
+	t.entries = int64(binary.BigEndian.Uint64(buf[:]))
+	n := int(binary.BigEndian.Uint64(buf[8:]))
+	t.keys = make([]int64,n)
+	t.raw = make(map[int64]int64,n)
+	t.index = make(map[int64]int,n)
+	if n==0 { return nil }
+	arr := make([]byte,n*16)
+	_,err = t.f.ReadAt(arr,t.entries)
+	if err!=nil { return err }
+	for i := range t.keys {
+		aligned := int64(binary.BigEndian.Uint64(arr[i*16:]))
+		t.keys[i] = aligned
+		t.raw[aligned] = int64(binary.BigEndian.Uint64(arr[i*16+8:]))
+		t.index[aligned] = i
+	}
+	return nil
+}
+// Reloads the table after a Rollback() of the underlying file.
+func (t *AlignedTable) Reload(a Allocator) error {
+	t.a = a
+	return t.load()
+}
+func (t *AlignedTable) writeRoot() error {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:],uint64(t.entries))
+	binary.BigEndian.PutUint64(buf[8:],uint64(len(t.keys)))
+	_,err := t.f.WriteAt(buf[:],t.root)
+	return err
+}
+func (t *AlignedTable) writeEntry(i int) error {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:],uint64(t.keys[i]))
+	binary.BigEndian.PutUint64(buf[8:],uint64(t.raw[t.keys[i]]))
+	_,err := t.f.WriteAt(buf[:],t.entries+int64(i)*16)
+	return err
+}
+// Makes room for one more entry in the array, moving it if necessary.
+func (t *AlignedTable) grow() error {
+	need := int64(len(t.keys)+1)*16
+	if t.entries!=0 {
+		usable,err := t.a.UsableSize(t.entries)
+		if err!=nil { return err }
+		if usable>=need { return nil }
+	}
+	off,err := t.a.Alloc(need*2)
+	if err!=nil { return err }
+	if len(t.keys)>0 {
+		arr := make([]byte,len(t.keys)*16)
+		_,err = t.f.ReadAt(arr,t.entries)
+		if err==nil { _,err = t.f.WriteAt(arr,off) }
+		if err!=nil {
+			if ferr := t.a.Free(off) ; ferr!=nil { return ferr }
+			return err
+		}
+	}
+	old := t.entries
+	t.entries = off
+	err = t.writeRoot()
+	if err!=nil {
+		t.entries = old
+		if ferr := t.a.Free(off) ; ferr!=nil { return ferr }
+		return err
+	}
+	if old!=0 { return t.a.Free(old) }
+	return nil
+}
+func (t *AlignedTable) insert(aligned, raw int64) error {
+	err := t.grow()
+	if err!=nil { return err }
+	t.keys = append(t.keys,aligned)
+	t.raw[aligned] = raw
+	t.index[aligned] = len(t.keys)-1
+	err = t.writeEntry(len(t.keys)-1)
+	if err==nil { err = t.writeRoot() }
+	if err!=nil { t.forget(aligned) }
+	return err
+}
+// Removes aligned from the in-memory table, moving the last entry into its place.
+func (t *AlignedTable) forget(aligned int64) {
+	i := t.index[aligned]
+	last := len(t.keys)-1
+	t.keys[i] = t.keys[last]
+	t.index[t.keys[i]] = i
+	t.keys = t.keys[:last]
+	delete(t.raw,aligned)
+	delete(t.index,aligned)
+}
+func (t *AlignedTable) remove(aligned int64) error {
+	i,raw := t.index[aligned],t.raw[aligned]
+	t.forget(aligned)
+	var err error
+	if i<len(t.keys) { err = t.writeEntry(i) }
+	if err==nil { err = t.writeRoot() }
+	if err!=nil {
+		// Undo the in-memory change; the moved entry goes back to the end.
+		t.keys = append(t.keys,aligned)
+		t.raw[aligned] = raw
+		if i<len(t.keys)-1 { t.keys[i],t.keys[len(t.keys)-1] = t.keys[len(t.keys)-1],t.keys[i] }
+		t.index[t.keys[i]] = i
+		t.index[t.keys[len(t.keys)-1]] = len(t.keys)-1
+	}
+	return err
+}
+// Returns the number of entries.
+func (t *AlignedTable) Len() int { return len(t.keys) }
+// Returns the offset of the underlying allocation, if off has been returned by AlignedAlloc().
+func (t *AlignedTable) Raw(off int64) (int64,bool) {
+	if t==nil { return 0,false }
+	raw,ok := t.raw[off]
+	return raw,ok
+}
+
+/*
+Returns the number of bytes AlignedAlloc() requests from an allocator, whose offsets are
+multiples of 16 (like file.Allocator), for a block of size bytes.
+*/
+func AlignedRawSize(size, align int64) int64 {
+	if align<=16 { return size }
+	return size+align-1
+}
+
+/*
+Allocates a block of at least size bytes at an offset, that is a multiple of align.
+
+Alignments up to 16 are satisfied by the allocator directly. For larger alignments, a larger
+block is allocated and the aligned offset within it is recorded in t, which must not be nil.
+AlignedFree(), AlignedUsableSize() and AlignedFootprint() must be used with such blocks.
+*/
+func AlignedAlloc(a Allocator, t *AlignedTable, size, align int64) (int64,error) {
+	if align<=0 || (align&(align-1))!=0 { return 0,EInvalidAlignment }
+	if align<=16 {
+		off,err := a.Alloc(size)
+		if err!=nil { return 0,err }
+		if off%align==0 { return off,nil }
+		err = a.Free(off)
+		if err!=nil { return 0,err }
+	}
+	if t==nil { return 0,ENoAlignedTable }
+	raw,err := a.Alloc(size+align-1)
+	if err!=nil { return 0,err }
+	aligned := (raw+align-1)&^(align-1)
+	if aligned==raw { return raw,nil }
+	err = t.insert(aligned,raw)
+	if err!=nil {
+		if ferr := a.Free(raw) ; ferr!=nil { return 0,ferr }
+		return 0,err
+	}
+	return aligned,nil
+}
+
+func AlignedFree(a Allocator, t *AlignedTable, off int64) error {
+	raw,ok := t.Raw(off)
+	if !ok { return a.Free(off) }
+	err := a.Free(raw)
+	if err!=nil { return err }
+	return t.remove(off)
+}
+
+func AlignedUsableSize(a Allocator, t *AlignedTable, off int64) (int64,error) {
+	raw,ok := t.Raw(off)
+	if !ok { return a.UsableSize(off) }
+	size,err := a.UsableSize(raw)
+	if err!=nil { return 0,err }
+	return raw+size-off,nil
+}
+
+// Returns the usable size of the underlying allocation, including the padding in front of off.
+func AlignedFootprint(a Allocator, t *AlignedTable, off int64) (int64,error) {
+	raw,ok := t.Raw(off)
+	if !ok { return a.UsableSize(off) }
+	return a.UsableSize(raw)
+}
+
+func AllocAtLeast(a Allocator, size int64) (int64,int64,error) {
+	off,err := a.Alloc(size)
+	if err!=nil { return 0,0,err }
+	usable,err := a.UsableSize(off)
+	if err!=nil { return 0,0,err }
+	return off,usable,nil
+}
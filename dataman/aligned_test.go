@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "testing"
+
+func newAligned(t *testing.T) *SimpleDataManager {
+	dm := newSimple(t)
+	root,err := NewAlignedRoot(dm)
+	if err!=nil { t.Fatal(err) }
+	if err = dm.UseAlignedTable(root) ; err!=nil { t.Fatal(err) }
+	return dm
+}
+
+func TestAlignedAlloc(t *testing.T) {
+	dm := newAligned(t)
+	for _,align := range []int64{1,16,64,4096} {
+		off,err := dm.AllocAligned(100,align)
+		if err!=nil { t.Fatal(err) }
+		if off%align!=0 { t.Fatalf("offset %d is not aligned to %d",off,align) }
+		usable,err := dm.UsableSize(off)
+		if err!=nil || usable<100 { t.Fatalf("usable size %d (%v)",usable,err) }
+		fp,err := dm.Footprint(off)
+		if err!=nil || fp<usable { t.Fatalf("footprint %d < usable size %d (%v)",fp,usable,err) }
+		if align>16 && fp>AlignedRawSize(100,align)+16 { t.Fatalf("footprint %d exceeds the raw size %d",fp,AlignedRawSize(100,align)) }
+		if err = dm.Free(off) ; err!=nil { t.Fatal(err) }
+	}
+}
+
+func TestAlignedNoTable(t *testing.T) {
+	dm := newSimple(t)
+	_,err := dm.AllocAligned(100,16)
+	if err!=nil { t.Fatal(err) }
+	_,err = dm.AllocAligned(100,4096)
+	if err!=ENoAlignedTable { t.Fatalf("expected ENoAlignedTable, got %v",err) }
+	_,err = dm.AllocAligned(100,48)
+	if err!=EInvalidAlignment { t.Fatalf("expected EInvalidAlignment, got %v",err) }
+}
+
+// Block contents, that look like the old in-band descriptors, are left alone.
+func TestAlignedContents(t *testing.T) {
+	dm := newAligned(t)
+	off,err := dm.Alloc(128)
+	if err!=nil { t.Fatal(err) }
+	buf := make([]byte,128)
+	for i := range buf { buf[i] = 0xff }
+	if _,err = dm.RollbackFile().WriteAt(buf,off) ; err!=nil { t.Fatal(err) }
+	usable,err := dm.UsableSize(off)
+	if err!=nil || usable<128 { t.Fatalf("usable size %d (%v)",usable,err) }
+	if err = dm.Free(off) ; err!=nil { t.Fatal(err) }
+}
+
+func TestAlignedReopen(t *testing.T) {
+	f := tempFile(t)
+	dm,err := NewSimpleDataManager(f)
+	if err!=nil { t.Fatal(err) }
+	root,err := NewAlignedRoot(dm)
+	if err!=nil { t.Fatal(err) }
+	if err = dm.UseAlignedTable(root) ; err!=nil { t.Fatal(err) }
+	
+	// Enough allocations to move the entry array a few times.
+	offs := make(map[int64]int64)
+	for i := 0 ; i<50 ; i++ {
+		off,err := dm.AllocAligned(200,256)
+		if err!=nil { t.Fatal(err) }
+		offs[off],err = dm.Footprint(off)
+		if err!=nil { t.Fatal(err) }
+	}
+	
+	dm,err = NewSimpleDataManager(f)
+	if err!=nil { t.Fatal(err) }
+	if err = dm.UseAlignedTable(root) ; err!=nil { t.Fatal(err) }
+	for off,fp := range offs {
+		got,err := dm.Footprint(off)
+		if err!=nil || got!=fp { t.Fatalf("footprint of %d: %d (%v), want %d",off,got,err,fp) }
+		if err = dm.Free(off) ; err!=nil { t.Fatal(err) }
+	}
+	if dm.t.Len()!=0 { t.Fatalf("%d entries left",dm.t.Len()) }
+}
@@ -24,6 +24,7 @@ SOFTWARE.
 package dataman
 
 import "github.com/cznic/file"
+import "math"
 import "sync"
 
 type DataManager interface{
@@ -32,9 +33,19 @@ type DataManager interface{
 	RollbackFile() file.File
 	
 	Alloc(size int64) (int64, error)
+	// Allocates a block of at least size bytes, whose offset is a multiple of align.
+	AllocAligned(size, align int64) (int64, error)
+	// Allocates a block of at least size bytes and returns its usable size.
+	AllocAtLeast(size int64) (int64, int64, error)
 	Free(off int64) error
 	UsableSize(off int64) (int64, error)
+	// Returns the number of bytes occupied by the allocation at off, including alignment padding.
+	Footprint(off int64) (int64, error)
 	Commit() error
+	// Discards all changes since the last Commit().
+	Rollback() error
+	// Registers a Listener for commit and rollback events.
+	Subscribe(l Listener) (cancel func())
 }
 
 type DataManagerLocked struct{
@@ -42,14 +53,61 @@ type DataManagerLocked struct{
 	sync.Mutex
 }
 
+/*
+A DataManager without transactions: RollbackFile() and DirectFile() are the same file,
+and Rollback() is not supported. Commit() emits an Event with the ranges, that have been
+written since the previous Commit().
+
+AllocAligned() with alignments above 16 requires an AlignedTable, see UseAlignedTable().
+*/
 type SimpleDataManager struct{
-	f file.File
+	Events
+	f *trackingFile
 	a *file.Allocator
+	t *AlignedTable
 }
 func NewSimpleDataManager(f file.File) (*SimpleDataManager,error) {
-	a,e := file.NewAllocator(f)
+	tf := &trackingFile{File:f}
+	a,e := file.NewAllocator(tf)
 	if e!=nil { return nil,e }
-	return &SimpleDataManager{f,a},nil
+	return &SimpleDataManager{f:tf,a:a},nil
+}
+
+// A file.File, that records the ranges, that are written or truncated.
+type trackingFile struct{
+	file.File
+	mutex   sync.Mutex
+	changed []Extent
+}
+func (t *trackingFile) record(off, n int64) {
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	t.changed = append(t.changed,Extent{off,n})
+	if len(t.changed)>=1024 && len(t.changed)&(len(t.changed)-1)==0 { t.changed = MergeExtents(t.changed) }
+}
+func (t *trackingFile) WriteAt(p []byte, off int64) (int,error) {
+	n,err := t.File.WriteAt(p,off)
+	if n>0 { t.record(off,int64(n)) }
+	return n,err
+}
+func (t *trackingFile) Truncate(size int64) error {
+	err := t.File.Truncate(size)
+	if err==nil { t.record(size,math.MaxInt64-size) }
+	return err
+}
+// Returns the recorded ranges, sorted and merged, and starts over.
+func (t *trackingFile) extents() []Extent {
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	ext := MergeExtents(t.changed)
+	t.changed = nil
+	return ext
+}
+
+// Opens the AlignedTable at root (see NewAlignedRoot()). Must be called after every reopen.
+func (s *SimpleDataManager) UseAlignedTable(root int64) error {
+	t,err := OpenAlignedTable(s.a,s.f,root)
+	if err!=nil { return err }
+	s.t = t
+	return nil
 }
 
 func (s *SimpleDataManager) Close() error { return s.a.Close() }
@@ -59,11 +117,24 @@ func (s *SimpleDataManager) RollbackFile() file.File { return s.f }
 func (s *SimpleDataManager) Alloc(size int64) (int64, error) {
 	return s.a.Alloc(size)
 }
+func (s *SimpleDataManager) AllocAligned(size, align int64) (int64, error) {
+	return AlignedAlloc(s.a,s.t,size,align)
+}
+func (s *SimpleDataManager) AllocAtLeast(size int64) (int64, int64, error) {
+	return AllocAtLeast(s,size)
+}
 func (s *SimpleDataManager) Free(off int64) error {
-	return s.a.Free(off)
+	return AlignedFree(s.a,s.t,off)
 }
 func (s *SimpleDataManager) UsableSize(off int64) (int64, error) {
-	return s.a.UsableSize(off)
+	return AlignedUsableSize(s.a,s.t,off)
+}
+func (s *SimpleDataManager) Footprint(off int64) (int64, error) {
+	return AlignedFootprint(s.a,s.t,off)
+}
+func (s *SimpleDataManager) Commit() error {
+	s.Emit(Event{Extents:s.f.extents()})
+	return nil
 }
-func (s *SimpleDataManager) Commit() error { return nil }
+func (s *SimpleDataManager) Rollback() error { return ENoRollback }
 
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "os"
+import "testing"
+
+func tempFile(t *testing.T) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"dataman")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func newSimple(t *testing.T) *SimpleDataManager {
+	dm,err := NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	return dm
+}
+
+// Commit() emits the ranges written since the previous Commit().
+func TestSimpleCommitExtents(t *testing.T) {
+	dm := newSimple(t)
+	off,err := dm.Alloc(100)
+	if err==nil { err = dm.Commit() }
+	if err!=nil { t.Fatal(err) }
+	var got []Extent
+	dm.Subscribe(func(ev Event) { got = ev.Extents })
+	
+	_,err = dm.RollbackFile().WriteAt([]byte("abc"),off)
+	if err==nil { _,err = dm.RollbackFile().WriteAt([]byte("def"),off+3) }
+	if err==nil { err = dm.Commit() }
+	if err!=nil { t.Fatal(err) }
+	if len(got)!=1 || got[0]!=(Extent{off,6}) { t.Fatalf("got %v, want [{%d 6}]",got,off) }
+	
+	if err = dm.Commit() ; err!=nil { t.Fatal(err) }
+	if got==nil || len(got)!=0 { t.Fatalf("expected no extents, got %v",got) }
+}
+
+func TestMergeExtents(t *testing.T) {
+	got := MergeExtents([]Extent{{20,5},{0,10},{10,5},{30,1},{22,1}})
+	want := []Extent{{0,15},{20,5},{30,1}}
+	if len(got)!=len(want) { t.Fatalf("got %v, want %v",got,want) }
+	for i := range want {
+		if got[i]!=want[i] { t.Fatalf("got %v, want %v",got,want) }
+	}
+	if !Overlaps(got,14,1) || Overlaps(got,15,5) || !Overlaps(got,19,2) { t.Fatal("Overlaps() is wrong") }
+}
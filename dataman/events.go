@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dataman
+
+import "errors"
+import "sort"
+import "sync"
+
+var ENoRollback = errors.New("Rollback not supported")
+
+// A range of the file, that has been changed by a transaction.
+type Extent struct{
+	Off, Len int64
+}
+
+// Reports whether [off,off+n) overlaps one of the extents, that must be sorted by offset.
+func Overlaps(ext []Extent, off, n int64) bool {
+	i := sort.Search(len(ext),func(i int) bool { return ext[i].Off+ext[i].Len>off })
+	return i<len(ext) && ext[i].Off<off+n
+}
+
+// Sorts ext by offset and merges overlapping and adjacent extents. The result is never nil.
+func MergeExtents(ext []Extent) []Extent {
+	sort.Slice(ext,func(a,b int) bool { return ext[a].Off<ext[b].Off })
+	m := make([]Extent,0,len(ext))
+	for _,e := range ext {
+		if l := len(m)-1 ; l>=0 && e.Off<=m[l].Off+m[l].Len {
+			if end := e.Off+e.Len ; end>m[l].Off+m[l].Len { m[l].Len = end-m[l].Off }
+			continue
+		}
+		m = append(m,e)
+	}
+	return m
+}
+
+/*
+Emitted after a successful Commit() or Rollback(). Extents are the ranges, whose content
+has changed in the DirectFile() (on commit) or in the RollbackFile() (on rollback), sorted
+by offset. If Extents is nil, any part of the file might have changed.
+*/
+type Event struct{
+	Rollback bool
+	Extents  []Extent
+}
+
+type Listener func(ev Event)
+
+/*
+A list of listeners. DataManager implementations embed it to implement Subscribe().
+Listeners are called synchronously, they must not call back into the DataManager.
+*/
+type Events struct{
+	mutex sync.Mutex
+	subs  []subscription
+	next  int
+}
+type subscription struct{
+	id int
+	l  Listener
+}
+
+// Registers l and returns a function, that removes it again. Listeners are called in the order of registration.
+func (e *Events) Subscribe(l Listener) (cancel func()) {
+	e.mutex.Lock(); defer e.mutex.Unlock()
+	id := e.next
+	e.next++
+	e.subs = append(e.subs,subscription{id,l})
+	return func() {
+		e.mutex.Lock(); defer e.mutex.Unlock()
+		for i,s := range e.subs {
+			if s.id!=id { continue }
+			e.subs = append(e.subs[:i:i],e.subs[i+1:]...)
+			return
+		}
+	}
+}
+func (e *Events) Emit(ev Event) {
+	e.mutex.Lock()
+	subs := e.subs
+	e.mutex.Unlock()
+	for _,s := range subs { s.l(ev) }
+}
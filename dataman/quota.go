@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "encoding/binary"
+import "fmt"
+
+type EQuotaExceeded struct{
+	Limit, Usage, Size int64
+}
+func (e *EQuotaExceeded) Error() string {
+	return fmt.Sprintf("Quota exceeded: %d + %d bytes > %d",e.Usage,e.Size,e.Limit)
+}
+
+/*
+A DataManager-Wrapper, that limits the number of allocated bytes (as reported by Footprint),
+so alignment padding is charged as well.
+
+The usage counter is stored in the file and updated through the RollbackFile(), so it is
+part of the same transaction as the allocation itself.
+*/
+type QuotaDataManager struct{
+	DataManager
+	Limit int64
+	root  int64
+	usage int64
+}
+
+// Allocate and Clear the usage counter of a QuotaDataManager.
+func NewQuotaRoot(dm DataManager) (int64,error) {
+	off,err := dm.Alloc(8)
+	if err!=nil { return 0,err }
+	_,err = dm.RollbackFile().WriteAt(make([]byte,8),off)
+	if err!=nil { return 0,err }
+	return off,nil
+}
+
+func NewQuotaDataManager(dm DataManager, root, limit int64) (*QuotaDataManager,error) {
+	q := &QuotaDataManager{DataManager:dm,Limit:limit,root:root}
+	err := q.load()
+	if err!=nil { return nil,err }
+	return q,nil
+}
+func (q *QuotaDataManager) load() error {
+	var buf [8]byte
+	_,err := q.RollbackFile().ReadAt(buf[:],q.root)
+	if err!=nil { return err }
+	q.usage = int64(binary.BigEndian.Uint64(buf[:]))
+	return nil
+}
+func (q *QuotaDataManager) setUsage(usage int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:],uint64(usage))
+	_,err := q.RollbackFile().WriteAt(buf[:],q.root)
+	if err!=nil { return err }
+	q.usage = usage
+	return nil
+}
+
+// Returns the number of allocated bytes.
+func (q *QuotaDataManager) Usage() int64 { return q.usage }
+
+func (q *QuotaDataManager) check(size int64) error {
+	if q.usage+size>q.Limit { return &EQuotaExceeded{q.Limit,q.usage,size} }
+	return nil
+}
+func (q *QuotaDataManager) account(off int64) error {
+	size,err := q.DataManager.Footprint(off)
+	if err==nil { err = q.check(size) }
+	if err==nil { err = q.setUsage(q.usage+size) }
+	if err!=nil {
+		if ferr := q.DataManager.Free(off) ; ferr!=nil { return fmt.Errorf("%v (freeing %d: %v)",err,off,ferr) }
+		return err
+	}
+	return nil
+}
+func (q *QuotaDataManager) Alloc(size int64) (int64, error) {
+	if err := q.check(size) ; err!=nil { return 0,err }
+	off,err := q.DataManager.Alloc(size)
+	if err!=nil { return 0,err }
+	err = q.account(off)
+	if err!=nil { return 0,err }
+	return off,nil
+}
+func (q *QuotaDataManager) AllocAligned(size, align int64) (int64, error) {
+	if err := q.check(AlignedRawSize(size,align)) ; err!=nil { return 0,err }
+	off,err := q.DataManager.AllocAligned(size,align)
+	if err!=nil { return 0,err }
+	err = q.account(off)
+	if err!=nil { return 0,err }
+	return off,nil
+}
+func (q *QuotaDataManager) AllocAtLeast(size int64) (int64, int64, error) {
+	if err := q.check(size) ; err!=nil { return 0,0,err }
+	off,err := q.DataManager.Alloc(size)
+	if err!=nil { return 0,0,err }
+	err = q.account(off)
+	if err!=nil { return 0,0,err }
+	usable,err := q.DataManager.UsableSize(off)
+	if err!=nil { return 0,0,err }
+	return off,usable,nil
+}
+func (q *QuotaDataManager) Free(off int64) error {
+	size,err := q.DataManager.Footprint(off)
+	if err!=nil { return err }
+	err = q.DataManager.Free(off)
+	if err!=nil { return err }
+	return q.setUsage(q.usage-size)
+}
+// Discards all changes since the last Commit() and reloads the usage counter.
+func (q *QuotaDataManager) Rollback() error {
+	err := q.DataManager.Rollback()
+	if err!=nil { return err }
+	return q.load()
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "os"
+import "testing"
+
+func newQuota(t *testing.T, limit int64) *QuotaDataManager {
+	dm := newAligned(t)
+	root,err := NewQuotaRoot(dm)
+	if err!=nil { t.Fatal(err) }
+	q,err := NewQuotaDataManager(dm,root,limit)
+	if err!=nil { t.Fatal(err) }
+	return q
+}
+
+func TestQuotaAccounting(t *testing.T) {
+	q := newQuota(t,1<<20)
+	off,err := q.Alloc(100)
+	if err!=nil { t.Fatal(err) }
+	fp,err := q.Footprint(off)
+	if err!=nil { t.Fatal(err) }
+	if q.Usage()!=fp { t.Fatalf("usage %d, want %d",q.Usage(),fp) }
+	if err = q.Free(off) ; err!=nil { t.Fatal(err) }
+	if q.Usage()!=0 { t.Fatalf("usage %d after Free()",q.Usage()) }
+}
+
+// The padding of aligned allocations is charged.
+func TestQuotaAligned(t *testing.T) {
+	q := newQuota(t,1<<20)
+	off,err := q.AllocAligned(100,4096)
+	if err!=nil { t.Fatal(err) }
+	if q.Usage()<4096 { t.Fatalf("usage %d does not include the padding",q.Usage()) }
+	if err = q.Free(off) ; err!=nil { t.Fatal(err) }
+	if q.Usage()!=0 { t.Fatalf("usage %d after Free()",q.Usage()) }
+	
+	q.Limit = 1000
+	_,err = q.AllocAligned(100,4096)
+	if _,ok := err.(*EQuotaExceeded) ; !ok { t.Fatalf("expected EQuotaExceeded, got %v",err) }
+	_,err = q.AllocAligned(100,16)
+	if err!=nil { t.Fatal(err) }
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	q := newQuota(t,256)
+	_,err := q.Alloc(200)
+	if err!=nil { t.Fatal(err) }
+	usage := q.Usage()
+	_,err = q.Alloc(200)
+	if _,ok := err.(*EQuotaExceeded) ; !ok { t.Fatalf("expected EQuotaExceeded, got %v",err) }
+	if q.Usage()!=usage { t.Fatalf("usage changed from %d to %d",usage,q.Usage()) }
+}
+
+// Free() returns the credit, so the space can be allocated again.
+func TestQuotaFree(t *testing.T) {
+	q := newQuota(t,256)
+	off,err := q.Alloc(200)
+	if err!=nil { t.Fatal(err) }
+	if _,err = q.Alloc(200) ; err==nil { t.Fatal("the second allocation exceeds the limit") }
+	if err = q.Free(off) ; err!=nil { t.Fatal(err) }
+	if q.Usage()!=0 { t.Fatalf("usage %d after Free()",q.Usage()) }
+	if _,err = q.Alloc(200) ; err!=nil { t.Fatal(err) }
+}
+
+// The usage counter is stored in the file.
+func TestQuotaReopen(t *testing.T) {
+	q := newQuota(t,1<<20)
+	for i := 0 ; i<3 ; i++ {
+		if _,err := q.Alloc(100) ; err!=nil { t.Fatal(err) }
+	}
+	r,err := NewQuotaDataManager(q.DataManager,q.root,q.Limit)
+	if err!=nil { t.Fatal(err) }
+	if r.Usage()!=q.Usage() || r.Usage()==0 { t.Fatalf("reopened with usage %d, want %d",r.Usage(),q.Usage()) }
+}
+
+// A DataManager, that rolls back by restoring the copy of the file taken by Commit().
+type snapshot struct{
+	*SimpleDataManager
+	f     *os.File
+	saved []byte
+}
+func (s *snapshot) Commit() error {
+	err := s.SimpleDataManager.Commit()
+	if err!=nil { return err }
+	s.saved,err = os.ReadFile(s.f.Name())
+	return err
+}
+func (s *snapshot) Rollback() error {
+	err := s.f.Truncate(0)
+	if err!=nil { return err }
+	_,err = s.f.WriteAt(s.saved,0)
+	if err!=nil { return err }
+	// The allocator keeps its state in memory, so it is reopened.
+	s.SimpleDataManager,err = NewSimpleDataManager(s.f)
+	return err
+}
+
+// Rollback() restores the usage counter of the last Commit().
+func TestQuotaRollback(t *testing.T) {
+	f := tempFile(t)
+	dm,err := NewSimpleDataManager(f)
+	if err!=nil { t.Fatal(err) }
+	s := &snapshot{SimpleDataManager:dm,f:f}
+	root,err := NewQuotaRoot(s)
+	if err!=nil { t.Fatal(err) }
+	q,err := NewQuotaDataManager(s,root,256)
+	if err!=nil { t.Fatal(err) }
+	if _,err = q.Alloc(100) ; err!=nil { t.Fatal(err) }
+	if err = q.Commit() ; err!=nil { t.Fatal(err) }
+	usage := q.Usage()
+	
+	if _,err = q.Alloc(100) ; err!=nil { t.Fatal(err) }
+	if err = q.Rollback() ; err!=nil { t.Fatal(err) }
+	if q.Usage()!=usage { t.Fatalf("usage %d after Rollback(), want %d",q.Usage(),usage) }
+	
+	// The rolled back allocation no longer counts against the limit.
+	if _,err = q.Alloc(100) ; err!=nil { t.Fatal(err) }
+	if _,err = q.Alloc(100) ; err==nil { t.Fatal("the limit is not enforced after Rollback()") }
+}
@@ -0,0 +1,286 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "math/bits"
+import "sort"
+
+var EInvalidSlabOffset = errors.New("Invalid slab offset")
+var ESlabFull = errors.New("Slab has no free object")
+
+// The size of a Slab, that is allocated from the underlying DataManager.
+const SlabSize = 0x8000
+
+var slabClasses = [...]int64{16,32,48,64,96,128,192,256,384,512,768,1024,1536,2048}
+
+/*
+[ Next:8 | Class:4 | Used:4 | Bitmap ... | Objects ... ]
+
+Used is only informational: It is written separately from the bitmap, so it may be
+stale after a crash. The bitmap is authoritative, Used is recomputed from it on load.
+*/
+const (
+	sl_next  = 0
+	sl_class = 8
+	sl_used  = 12
+	sl_bits  = 16
+)
+
+func slabClass(size int64) int {
+	for i,cs := range slabClasses {
+		if size<=cs { return i }
+	}
+	return -1
+}
+
+// Returns the number of objects per slab and the offset of the first object.
+func slabGeometry(class int) (n int,data int64) {
+	cs := slabClasses[class]
+	n = int((SlabSize-sl_bits)*8/(cs*8+1))
+	for {
+		data = (sl_bits+int64(n+7)/8+15)&^15
+		if data+int64(n)*cs<=SlabSize { return }
+		n--
+	}
+}
+
+type slab struct{
+	off   int64
+	class int
+	used  int
+	bits  []byte
+	n     int
+	data  int64
+}
+func (s *slab) size() int64 { return slabClasses[s.class] }
+
+/*
+A DataManager-Wrapper, that carves small allocations out of slabs of fixed size classes.
+
+Allocations larger than the largest size class and aligned allocations are forwarded to the
+underlying DataManager.
+The slabs of every size class are chained together, the heads of the chains are stored
+in the root block. Every slab holds a bitmap of its used objects.
+*/
+type SlabDataManager struct{
+	DataManager
+	root   int64
+	chains [len(slabClasses)][]*slab
+	all    []*slab // sorted by offset
+}
+
+// Allocate and Clear the root block of a SlabDataManager.
+func NewSlabRoot(dm DataManager) (int64,error) {
+	size := int64(len(slabClasses)*8)
+	off,err := dm.Alloc(size)
+	if err!=nil { return 0,err }
+	_,err = dm.RollbackFile().WriteAt(make([]byte,size),off)
+	if err!=nil { return 0,err }
+	return off,nil
+}
+
+func NewSlabDataManager(dm DataManager, root int64) (*SlabDataManager,error) {
+	s := &SlabDataManager{DataManager:dm,root:root}
+	err := s.load()
+	if err!=nil { return nil,err }
+	return s,nil
+}
+func (s *SlabDataManager) load() error {
+	f := s.RollbackFile()
+	var buf [sl_bits]byte
+	heads := make([]byte,len(slabClasses)*8)
+	_,err := f.ReadAt(heads,s.root)
+	if err!=nil { return err }
+	s.all = nil
+	for c := range s.chains {
+		s.chains[c] = nil
+		off := int64(binary.BigEndian.Uint64(heads[c*8:]))
+		for off!=0 {
+			_,err = f.ReadAt(buf[:],off)
+			if err!=nil { return err }
+			if int(binary.BigEndian.Uint32(buf[sl_class:]))!=c { return EInvalidSlabOffset }
+			sl := &slab{off:off,class:c}
+			sl.n,sl.data = slabGeometry(c)
+			sl.bits = make([]byte,(sl.n+7)/8)
+			_,err = f.ReadAt(sl.bits,off+sl_bits)
+			if err!=nil { return err }
+			for _,b := range sl.bits { sl.used += bits.OnesCount8(b) }
+			s.chains[c] = append(s.chains[c],sl)
+			s.all = append(s.all,sl)
+			off = int64(binary.BigEndian.Uint64(buf[sl_next:]))
+		}
+	}
+	sort.Slice(s.all,func(i,j int) bool { return s.all[i].off<s.all[j].off })
+	return nil
+}
+func (s *SlabDataManager) find(off int64) *slab {
+	i := sort.Search(len(s.all),func(i int) bool { return s.all[i].off>off })
+	if i==0 { return nil }
+	sl := s.all[i-1]
+	if off<sl.off+SlabSize { return sl }
+	return nil
+}
+func (s *SlabDataManager) writeNext(c, i int, next int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:],uint64(next))
+	pos := s.root+int64(c*8)
+	if i>=0 { pos = s.chains[c][i].off+sl_next }
+	_,err := s.RollbackFile().WriteAt(buf[:],pos)
+	return err
+}
+func (s *SlabDataManager) writeUsed(sl *slab, idx int) error {
+	var buf [4]byte
+	f := s.RollbackFile()
+	binary.BigEndian.PutUint32(buf[:],uint32(sl.used))
+	_,err := f.WriteAt(buf[:],sl.off+sl_used)
+	if err!=nil { return err }
+	_,err = f.WriteAt(sl.bits[idx/8:idx/8+1],sl.off+sl_bits+int64(idx/8))
+	return err
+}
+func (s *SlabDataManager) newSlab(c int) (*slab,error) {
+	off,err := s.DataManager.Alloc(SlabSize)
+	if err!=nil { return nil,err }
+	sl := &slab{off:off,class:c}
+	sl.n,sl.data = slabGeometry(c)
+	sl.bits = make([]byte,(sl.n+7)/8)
+	
+	var next int64
+	if len(s.chains[c])>0 { next = s.chains[c][0].off }
+	hdr := make([]byte,sl.data)
+	binary.BigEndian.PutUint64(hdr[sl_next:],uint64(next))
+	binary.BigEndian.PutUint32(hdr[sl_class:],uint32(c))
+	_,err = s.RollbackFile().WriteAt(hdr,off)
+	if err!=nil { return nil,err }
+	err = s.writeNext(c,-1,off)
+	if err!=nil { return nil,err }
+	
+	s.chains[c] = append([]*slab{sl},s.chains[c]...)
+	i := sort.Search(len(s.all),func(i int) bool { return s.all[i].off>off })
+	s.all = append(s.all,nil)
+	copy(s.all[i+1:],s.all[i:])
+	s.all[i] = sl
+	return sl,nil
+}
+// The slab is only dropped from memory, once it has been unlinked and freed.
+func (s *SlabDataManager) freeSlab(sl *slab) error {
+	c := sl.class
+	ch := s.chains[c]
+	i := 0
+	for ch[i]!=sl { i++ }
+	var next int64
+	if i+1<len(ch) { next = ch[i+1].off }
+	err := s.writeNext(c,i-1,next)
+	if err!=nil { return err }
+	err = s.DataManager.Free(sl.off)
+	if err!=nil {
+		if e := s.writeNext(c,i-1,sl.off) ; e!=nil { return fmt.Errorf("%w (relinking the slab failed: %v)",err,e) }
+		return err
+	}
+	s.chains[c] = append(ch[:i],ch[i+1:]...)
+	j := sort.Search(len(s.all),func(j int) bool { return s.all[j].off>=sl.off })
+	s.all = append(s.all[:j],s.all[j+1:]...)
+	return nil
+}
+
+func (s *SlabDataManager) Alloc(size int64) (int64, error) {
+	c := slabClass(size)
+	if c<0 { return s.DataManager.Alloc(size) }
+	var sl *slab
+	for _,o := range s.chains[c] {
+		if o.used<o.n { sl = o; break }
+	}
+	if sl==nil {
+		var err error
+		sl,err = s.newSlab(c)
+		if err!=nil { return 0,err }
+	}
+	for i,b := range sl.bits {
+		if b==0xff { continue }
+		for j := 0 ; j<8 ; j++ {
+			idx := i*8+j
+			if idx>=sl.n { break }
+			if (b>>uint(j))&1==1 { continue }
+			sl.bits[i] |= 1<<uint(j)
+			sl.used++
+			err := s.writeUsed(sl,idx)
+			if err!=nil {
+				sl.bits[i] &^= 1<<uint(j)
+				sl.used--
+				return 0,err
+			}
+			return sl.data+sl.off+int64(idx)*sl.size(),nil
+		}
+	}
+	return 0,ESlabFull
+}
+func (s *SlabDataManager) AllocAtLeast(size int64) (int64, int64, error) {
+	return AllocAtLeast(s,size)
+}
+func (s *SlabDataManager) object(off int64) (*slab,int,error) {
+	sl := s.find(off)
+	if sl==nil { return nil,0,nil }
+	rel := off-sl.off-sl.data
+	if rel<0 || rel%sl.size()!=0 { return nil,0,EInvalidSlabOffset }
+	idx := int(rel/sl.size())
+	if idx>=sl.n || (sl.bits[idx/8]>>uint(idx%8))&1==0 { return nil,0,EInvalidSlabOffset }
+	return sl,idx,nil
+}
+func (s *SlabDataManager) Free(off int64) error {
+	sl,idx,err := s.object(off)
+	if err!=nil { return err }
+	if sl==nil { return s.DataManager.Free(off) }
+	sl.bits[idx/8] &^= 1<<uint(idx%8)
+	sl.used--
+	if sl.used==0 {
+		err = s.freeSlab(sl)
+	} else {
+		err = s.writeUsed(sl,idx)
+	}
+	if err!=nil {
+		sl.bits[idx/8] |= 1<<uint(idx%8)
+		sl.used++
+	}
+	return err
+}
+func (s *SlabDataManager) UsableSize(off int64) (int64, error) {
+	sl,_,err := s.object(off)
+	if err!=nil { return 0,err }
+	if sl==nil { return s.DataManager.UsableSize(off) }
+	return sl.size(),nil
+}
+func (s *SlabDataManager) Footprint(off int64) (int64, error) {
+	sl,_,err := s.object(off)
+	if err!=nil { return 0,err }
+	if sl==nil { return s.DataManager.Footprint(off) }
+	return sl.size(),nil
+}
+// Discards all changes since the last Commit() and reloads the slabs.
+func (s *SlabDataManager) Rollback() error {
+	err := s.DataManager.Rollback()
+	if err!=nil { return err }
+	return s.load()
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "github.com/cznic/file"
+import "encoding/binary"
+import "errors"
+import "testing"
+
+func newSlab(t *testing.T, dm DataManager) *SlabDataManager {
+	root,err := NewSlabRoot(dm)
+	if err!=nil { t.Fatal(err) }
+	s,err := NewSlabDataManager(dm,root)
+	if err!=nil { t.Fatal(err) }
+	return s
+}
+
+func TestSlabAlloc(t *testing.T) {
+	s := newSlab(t,newSimple(t))
+	seen := make(map[int64]bool)
+	for _,size := range []int64{1,16,17,100,2048,100,1} {
+		off,err := s.Alloc(size)
+		if err!=nil { t.Fatal(err) }
+		if seen[off] { t.Fatalf("offset %d handed out twice",off) }
+		seen[off] = true
+		usable,err := s.UsableSize(off)
+		if err!=nil { t.Fatal(err) }
+		if usable<size || usable!=slabClasses[slabClass(size)] { t.Fatalf("size %d: usable size %d",size,usable) }
+	}
+	
+	// Larger allocations are forwarded.
+	off,err := s.Alloc(SlabSize)
+	if err!=nil { t.Fatal(err) }
+	if s.find(off)!=nil { t.Fatal("large allocation was served from a slab") }
+	err = s.Free(off)
+	if err!=nil { t.Fatal(err) }
+}
+
+func TestSlabFreeReuse(t *testing.T) {
+	s := newSlab(t,newSimple(t))
+	a,err := s.Alloc(32)
+	if err!=nil { t.Fatal(err) }
+	b,err := s.Alloc(32)
+	if err!=nil { t.Fatal(err) }
+	err = s.Free(a)
+	if err!=nil { t.Fatal(err) }
+	err = s.Free(a)
+	if err!=EInvalidSlabOffset { t.Fatalf("double free: expected EInvalidSlabOffset, got %v",err) }
+	c,err := s.Alloc(32)
+	if err!=nil { t.Fatal(err) }
+	if c!=a { t.Fatalf("freed object %d was not reused (got %d)",a,c) }
+	
+	// Freeing the last object releases the slab.
+	for _,off := range []int64{b,c} {
+		err = s.Free(off)
+		if err!=nil { t.Fatal(err) }
+	}
+	if len(s.all)!=0 { t.Fatalf("%d slabs left",len(s.all)) }
+}
+
+func TestSlabReload(t *testing.T) {
+	dm := newSimple(t)
+	s := newSlab(t,dm)
+	var offs []int64
+	for i := 0 ; i<100 ; i++ {
+		off,err := s.Alloc(48)
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,off)
+	}
+	
+	// A crash between the bitmap and the Used field leaves Used stale.
+	sl := s.find(offs[0])
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:],3)
+	_,err := dm.RollbackFile().WriteAt(buf[:],sl.off+sl_used)
+	if err!=nil { t.Fatal(err) }
+	
+	r,err := NewSlabDataManager(dm,s.root)
+	if err!=nil { t.Fatal(err) }
+	if r.find(offs[0]).used!=100 { t.Fatalf("used is %d after reload, want 100",r.find(offs[0]).used) }
+	for _,off := range offs {
+		if _,err = r.UsableSize(off) ; err!=nil { t.Fatalf("object %d lost: %v",off,err) }
+	}
+	seen := make(map[int64]bool)
+	for _,off := range offs { seen[off] = true }
+	for i := 100 ; i<sl.n ; i++ {
+		off,err := r.Alloc(48)
+		if err!=nil { t.Fatal(err) }
+		if seen[off] { t.Fatalf("allocated object %d twice",off) }
+		seen[off] = true
+	}
+}
+
+type failingFile struct{
+	file.File
+	fail *bool
+}
+func (f failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if *f.fail { return 0,errFail }
+	return f.File.WriteAt(p,off)
+}
+
+// Fails all writes to the RollbackFile() or all frees, while the respective flag is set.
+type failing struct{
+	DataManager
+	failWrite, failFree bool
+}
+func (f *failing) RollbackFile() file.File { return failingFile{f.DataManager.RollbackFile(),&f.failWrite} }
+func (f *failing) Free(off int64) error {
+	if f.failFree { return errFail }
+	return f.DataManager.Free(off)
+}
+
+var errFail = errors.New("injected failure")
+
+// A failed release of an empty slab leaves it allocated and chained.
+func TestSlabFreeFailure(t *testing.T) {
+	dm := &failing{DataManager:newSimple(t)}
+	s := newSlab(t,dm)
+	var offs []int64
+	for _,size := range []int64{64,64,64} {
+		off,err := s.Alloc(size)
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,off)
+	}
+	// A slab of another class, that must not be touched.
+	other,err := s.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	for _,off := range offs[1:] {
+		if err = s.Free(off) ; err!=nil { t.Fatal(err) }
+	}
+	
+	for _,flag := range []*bool{&dm.failWrite,&dm.failFree} {
+		*flag = true
+		err = s.Free(offs[0])
+		*flag = false
+		if !errors.Is(err,errFail) { t.Fatalf("expected the injected failure, got %v",err) }
+		if len(s.all)!=2 || len(s.chains[slabClass(64)])!=1 { t.Fatalf("slab dropped: %d slabs",len(s.all)) }
+		if _,err = s.UsableSize(offs[0]) ; err!=nil { t.Fatalf("object lost: %v",err) }
+		r,err := NewSlabDataManager(dm,s.root)
+		if err!=nil { t.Fatal(err) }
+		if len(r.all)!=2 { t.Fatalf("%d slabs after reload, want 2",len(r.all)) }
+	}
+	
+	if err = s.Free(offs[0]) ; err!=nil { t.Fatal(err) }
+	if len(s.all)!=1 || s.find(other)==nil { t.Fatalf("%d slabs left",len(s.all)) }
+	r,err := NewSlabDataManager(dm,s.root)
+	if err!=nil { t.Fatal(err) }
+	if len(r.all)!=1 { t.Fatalf("%d slabs after reload, want 1",len(r.all)) }
+}
@@ -0,0 +1,226 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "fmt"
+import "io"
+import "runtime/debug"
+import "sort"
+import "sync"
+
+// The default number of freed allocations and problems remembered by a TracingDataManager.
+const DefaultTraceHistory = 4096
+
+type AllocRecord struct{
+	Off   int64
+	Size  int64
+	Tag   string
+	Stack []byte
+}
+
+type ETraceFree struct{
+	Off    int64
+	Double bool         // true for double frees, false for frees of unknown offsets
+	Freed  *AllocRecord // The original allocation, if Double is true.
+}
+func (e *ETraceFree) Error() string {
+	if e.Double { return fmt.Sprintf("Double free of %d (allocated by %q)",e.Off,e.Freed.Tag) }
+	return fmt.Sprintf("Free of unknown offset %d",e.Off)
+}
+
+/*
+A DataManager-Wrapper, that records every Alloc() and Free() in order to detect leaks,
+double frees and frees of unknown offsets. It is safe for concurrent use, if the
+underlying DataManager is.
+
+Double frees are never forwarded to the underlying DataManager. Frees of unknown offsets
+are forwarded, unless Strict is set, because they might refer to allocations, that
+were made before tracing started. Double frees are only detected, as long as the
+freed allocation is among the last History ones.
+
+Rollback() undoes the records of all allocations and frees since the last Commit().
+*/
+type TracingDataManager struct{
+	DataManager
+	Stacks   bool      // Record a stack trace on every allocation.
+	Strict   bool      // Refuse frees of unknown offsets.
+	Out      io.Writer // If non-nil, Close() dumps the outstanding allocations to it.
+	History  int       // Zero means DefaultTraceHistory.
+	
+	mutex    sync.Mutex
+	live     map[int64]*AllocRecord
+	freed    map[int64]*AllocRecord
+	order    []*AllocRecord // The freed records, oldest first.
+	problems []error
+	undo     []traceUndo
+	before   []*AllocRecord // order at the last Commit(), valid while undo is non-empty.
+}
+
+// The records of an offset before a change.
+type traceUndo struct{
+	off         int64
+	live, freed *AllocRecord
+}
+
+func NewTracingDataManager(dm DataManager) *TracingDataManager {
+	return &TracingDataManager{
+		DataManager:dm,
+		live:make(map[int64]*AllocRecord),
+		freed:make(map[int64]*AllocRecord),
+	}
+}
+
+// Returns a view of t, that records its allocations with tag.
+func (t *TracingDataManager) Tagged(tag string) DataManager { return &taggedDataManager{t,tag} }
+
+type taggedDataManager struct{
+	*TracingDataManager
+	tag string
+}
+func (t *taggedDataManager) Alloc(size int64) (int64, error) { return t.alloc(size,t.tag) }
+func (t *taggedDataManager) AllocAligned(size, align int64) (int64, error) { return t.allocAligned(size,align,t.tag) }
+func (t *taggedDataManager) AllocAtLeast(size int64) (int64, int64, error) { return t.allocAtLeast(size,t.tag) }
+
+func (t *TracingDataManager) history() int {
+	if t.History<=0 { return DefaultTraceHistory }
+	return t.History
+}
+// Called with mutex held. Free() only appends to order and drops from its front, so the snapshot stays intact.
+func (t *TracingDataManager) change(off int64) {
+	if len(t.undo)==0 { t.before = t.order }
+	t.undo = append(t.undo,traceUndo{off,t.live[off],t.freed[off]})
+}
+func (t *TracingDataManager) problem(err error) {
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	if len(t.problems)>=t.history() { t.problems = t.problems[1:] }
+	t.problems = append(t.problems,err)
+}
+func (t *TracingDataManager) record(off, size int64, tag string) {
+	r := &AllocRecord{Off:off,Size:size,Tag:tag}
+	if t.Stacks { r.Stack = debug.Stack() }
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	t.change(off)
+	delete(t.freed,off)
+	t.live[off] = r
+}
+func (t *TracingDataManager) alloc(size int64, tag string) (int64, error) {
+	off,err := t.DataManager.Alloc(size)
+	if err!=nil { return 0,err }
+	t.record(off,size,tag)
+	return off,nil
+}
+func (t *TracingDataManager) allocAligned(size, align int64, tag string) (int64, error) {
+	off,err := t.DataManager.AllocAligned(size,align)
+	if err!=nil { return 0,err }
+	t.record(off,size,tag)
+	return off,nil
+}
+func (t *TracingDataManager) allocAtLeast(size int64, tag string) (int64, int64, error) {
+	off,usable,err := t.DataManager.AllocAtLeast(size)
+	if err!=nil { return 0,0,err }
+	t.record(off,size,tag)
+	return off,usable,nil
+}
+func (t *TracingDataManager) Alloc(size int64) (int64, error) { return t.alloc(size,"") }
+func (t *TracingDataManager) AllocAligned(size, align int64) (int64, error) { return t.allocAligned(size,align,"") }
+func (t *TracingDataManager) AllocAtLeast(size int64) (int64, int64, error) { return t.allocAtLeast(size,"") }
+
+func (t *TracingDataManager) Free(off int64) error {
+	t.mutex.Lock()
+	r,ok := t.live[off]
+	e := &ETraceFree{Off:off}
+	if !ok { e.Freed,e.Double = t.freed[off] }
+	t.mutex.Unlock()
+	if !ok {
+		t.problem(e)
+		if e.Double || t.Strict { return e }
+		return t.DataManager.Free(off)
+	}
+	err := t.DataManager.Free(off)
+	if err!=nil { return err }
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	t.change(off)
+	delete(t.live,off)
+	t.freed[off] = r
+	t.order = append(t.order,r)
+	for len(t.freed)>t.history() {
+		o := t.order[0]
+		t.order = t.order[1:]
+		if t.freed[o.Off]==o {
+			t.change(o.Off)
+			delete(t.freed,o.Off)
+		}
+	}
+	return nil
+}
+
+// Returns the detected problems (the last History ones).
+func (t *TracingDataManager) Problems() []error {
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	return append([]error(nil),t.problems...)
+}
+
+func (t *TracingDataManager) Commit() error {
+	err := t.DataManager.Commit()
+	if err!=nil { return err }
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	t.undo,t.before = nil,nil
+	return nil
+}
+// Discards all changes since the last Commit(), including the records of the allocations and frees.
+func (t *TracingDataManager) Rollback() error {
+	err := t.DataManager.Rollback()
+	if err!=nil { return err }
+	t.mutex.Lock(); defer t.mutex.Unlock()
+	for i := len(t.undo)-1 ; i>=0 ; i-- {
+		u := t.undo[i]
+		if u.live!=nil { t.live[u.off] = u.live } else { delete(t.live,u.off) }
+		if u.freed!=nil { t.freed[u.off] = u.freed } else { delete(t.freed,u.off) }
+	}
+	if len(t.undo)>0 { t.order = t.before }
+	t.undo,t.before = nil,nil
+	return nil
+}
+
+// Returns the outstanding allocations, ordered by offset.
+func (t *TracingDataManager) Outstanding() []*AllocRecord {
+	t.mutex.Lock()
+	recs := make([]*AllocRecord,0,len(t.live))
+	for _,r := range t.live { recs = append(recs,r) }
+	t.mutex.Unlock()
+	sort.Slice(recs,func(i,j int) bool { return recs[i].Off<recs[j].Off })
+	return recs
+}
+
+// Writes the outstanding allocations to w.
+func (t *TracingDataManager) Dump(w io.Writer) {
+	for _,r := range t.Outstanding() {
+		fmt.Fprintf(w,"%d: %d bytes, tag %q\n",r.Off,r.Size,r.Tag)
+		if len(r.Stack)>0 { fmt.Fprintf(w,"%s\n",r.Stack) }
+	}
+}
+func (t *TracingDataManager) Close() error {
+	if t.Out!=nil { t.Dump(t.Out) }
+	return t.DataManager.Close()
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package dataman
+
+import "errors"
+import "testing"
+
+// A DataManager, that pretends to support Rollback().
+type fakeRollback struct{ *SimpleDataManager }
+func (fakeRollback) Rollback() error { return nil }
+
+func newTracing(t *testing.T) *TracingDataManager {
+	return NewTracingDataManager(fakeRollback{newSimple(t)})
+}
+
+func TestTraceDoubleFree(t *testing.T) {
+	tr := newTracing(t)
+	off,err := tr.Tagged("node").Alloc(32)
+	if err!=nil { t.Fatal(err) }
+	if err = tr.Free(off) ; err!=nil { t.Fatal(err) }
+	err = tr.Free(off)
+	e,ok := err.(*ETraceFree)
+	if !ok || !e.Double || e.Freed.Tag!="node" { t.Fatalf("expected a double free of a \"node\", got %v",err) }
+	if len(tr.Problems())!=1 { t.Fatalf("expected one problem, got %v",tr.Problems()) }
+	
+	tr.Strict = true
+	err = tr.Free(off+1<<20)
+	if e,ok = err.(*ETraceFree) ; !ok || e.Double { t.Fatalf("expected a free of an unknown offset, got %v",err) }
+}
+
+func TestTraceTagged(t *testing.T) {
+	tr := newTracing(t)
+	a,b := tr.Tagged("a"),tr.Tagged("b")
+	oa,err := a.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	ob,err := b.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	o,err := tr.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	tags := map[int64]string{oa:"a",ob:"b",o:""}
+	for _,r := range tr.Outstanding() {
+		if tags[r.Off]!=r.Tag { t.Fatalf("allocation %d has tag %q, expected %q",r.Off,r.Tag,tags[r.Off]) }
+	}
+}
+
+func TestTraceRollback(t *testing.T) {
+	tr := newTracing(t)
+	kept,err := tr.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	if err = tr.Commit() ; err!=nil { t.Fatal(err) }
+	
+	dropped,err := tr.Alloc(16)
+	if err!=nil { t.Fatal(err) }
+	if err = tr.Free(kept) ; err!=nil { t.Fatal(err) }
+	if err = tr.Rollback() ; err!=nil { t.Fatal(err) }
+	
+	recs := tr.Outstanding()
+	if len(recs)!=1 || recs[0].Off!=kept { t.Fatalf("expected only %d to be outstanding, got %v (dropped %d)",kept,recs,dropped) }
+	tr.mutex.Lock()
+	_,freed := tr.freed[kept]
+	tr.mutex.Unlock()
+	if freed { t.Fatal("the free has not been undone") }
+}
+
+// Rollback() restores the freed records and their order, including the evicted ones.
+func TestTraceRollbackOrder(t *testing.T) {
+	tr := newTracing(t)
+	tr.History = 2
+	var offs []int64
+	for i := 0 ; i<3 ; i++ {
+		off,err := tr.Alloc(16)
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,off)
+	}
+	for _,off := range offs[:2] {
+		if err := tr.Free(off) ; err!=nil { t.Fatal(err) }
+	}
+	if err := tr.Commit() ; err!=nil { t.Fatal(err) }
+	
+	if err := tr.Free(offs[2]) ; err!=nil { t.Fatal(err) }
+	if err := tr.Rollback() ; err!=nil { t.Fatal(err) }
+	tr.mutex.Lock()
+	order := append([]*AllocRecord(nil),tr.order...)
+	n := len(tr.freed)
+	tr.mutex.Unlock()
+	if len(order)!=2 || order[0].Off!=offs[0] || order[1].Off!=offs[1] || n!=2 { t.Fatalf("order after rollback: %v, %d freed",order,n) }
+	var e *ETraceFree
+	if err := tr.Free(offs[0]) ; !errors.As(err,&e) || !e.Double { t.Fatalf("expected a double free, got %v",err) }
+	
+	// The oldest record is still the first to be forgotten.
+	off,err := tr.Alloc(16)
+	if err==nil { err = tr.Free(off) }
+	if err!=nil { t.Fatal(err) }
+	tr.mutex.Lock()
+	n = len(tr.freed)
+	_,second := tr.freed[offs[1]]
+	tr.mutex.Unlock()
+	if n!=2 || !second { t.Fatalf("the wrong record has been forgotten, %d remembered",n) }
+}
+
+func TestTraceHistory(t *testing.T) {
+	tr := newTracing(t)
+	tr.History = 2
+	var offs []int64
+	for i := 0 ; i<3 ; i++ {
+		off,err := tr.Alloc(16)
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,off)
+	}
+	for _,off := range offs {
+		if err := tr.Free(off) ; err!=nil { t.Fatal(err) }
+	}
+	tr.mutex.Lock()
+	n := len(tr.freed)
+	_,first := tr.freed[offs[0]]
+	tr.mutex.Unlock()
+	if n!=2 || first { t.Fatalf("expected the oldest free to be forgotten, %d remembered",n) }
+	
+	tr.Strict = true
+	for i := 0 ; i<5 ; i++ { tr.Free(1<<30) }
+	if len(tr.Problems())!=2 { t.Fatalf("expected 2 problems, got %d",len(tr.Problems())) }
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/valyala/bytebufferpool"
+import "encoding/binary"
+import "hash/crc32"
+import "fmt"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// [ Length:4 | CRC32C:4 | Payload ... ]
+const frameHead = 8
+
+type ECorrupt struct{
+	Off    int64
+	Reason string
+}
+func (e *ECorrupt) Error() string { return fmt.Sprintf("Corrupt block at %d: %s",e.Off,e.Reason) }
+
+// Wraps the encoded block in buf.B into a frame.
+func frame(buf *bytebufferpool.ByteBuffer) {
+	n := len(buf.B)
+	var head [frameHead]byte
+	buf.B = append(buf.B,head[:]...)
+	copy(buf.B[frameHead:],buf.B[:n])
+	binary.BigEndian.PutUint32(buf.B,uint32(n))
+	binary.BigEndian.PutUint32(buf.B[4:],crc32.Checksum(buf.B[frameHead:],castagnoli))
+}
+
+// Verifies the frame in b and returns its payload.
+func unframe(b []byte, off int64) ([]byte,error) {
+	if len(b)<frameHead { return nil,&ECorrupt{off,"block smaller than frame header"} }
+	n := int64(binary.BigEndian.Uint32(b))
+	if n>int64(len(b)-frameHead) { return nil,&ECorrupt{off,fmt.Sprintf("length %d exceeds block",n)} }
+	p := b[frameHead:frameHead+int(n)]
+	if crc32.Checksum(p,castagnoli)!=binary.BigEndian.Uint32(b[4:]) { return nil,&ECorrupt{off,"checksum mismatch"} }
+	return p,nil
+}
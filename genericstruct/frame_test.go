@@ -0,0 +1,71 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "testing"
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytebufferpool.ByteBuffer{B:[]byte("payload")}
+	frame(buf)
+	framed := append([]byte(nil),buf.B...)
+	// Blocks are read with their usable size, so there may be trailing bytes.
+	p,err := unframe(append(framed,0,0,0),42)
+	if err!=nil { t.Fatal(err) }
+	if string(p)!="payload" { t.Fatalf("got %q",p) }
+	
+	for i := range framed {
+		b := append([]byte(nil),framed...)
+		b[i] ^= 1
+		if _,err = unframe(b,42) ; err==nil { t.Fatalf("flipped bit in byte %d not detected",i) }
+	}
+	if _,err = unframe(framed[:5],42) ; err==nil { t.Fatal("short block not detected") }
+}
+
+func TestChecksum(t *testing.T) {
+	m := newTestMaster()
+	m.Checksum = true
+	dm := newDataManager(t)
+	off,err := m.Open(dm,false).Set(&testBlock{Data:[]byte("checked")})
+	if err!=nil { t.Fatal(err) }
+	if got := reread(t,m,dm,off) ; string(got)!="checked" { t.Fatalf("got %q",got) }
+	
+	_,err = dm.RollbackFile().WriteAt([]byte("X"),off+frameHead)
+	if err!=nil { t.Fatal(err) }
+	_,err = m.Open(dm,true).Get(off)
+	if e,ok := err.(*ECorrupt) ; !ok || e.Off!=off { t.Fatalf("expected ECorrupt at %d, got %v",off,err) }
+}
+
+// Blocks written before Checksum was enabled are rejected.
+func TestChecksumUnframed(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	off,err := m.Open(dm,false).Set(&testBlock{Data:bytes.Repeat([]byte("plain"),4)})
+	if err!=nil { t.Fatal(err) }
+	m = newTestMaster()
+	m.Checksum = true
+	_,err = m.Open(dm,true).Get(off)
+	if _,ok := err.(*ECorrupt) ; !ok { t.Fatalf("expected ECorrupt, got %v",err) }
+}
@@ -28,105 +28,531 @@ import "github.com/hashicorp/golang-lru/simplelru"
 import "github.com/valyala/bytebufferpool"
 import "github.com/cznic/file"
 import "errors"
+import "fmt"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
 
 var ErrReadOnly = errors.New("ReadOnly")
+var ErrBlockTooLarge = errors.New("Block too large for its allocation")
+var ErrBlockPinned = errors.New("Block is pinned")
+
+type EWriteBack struct{
+	Off   int64
+	Inner error
+}
+func (e *EWriteBack) Error() string { return fmt.Sprintf("Write-back of %d failed: %v",e.Off,e.Inner) }
+
+type EFlush []error
+func (e EFlush) Error() string {
+	s := make([]string,len(e))
+	for i,err := range e { s[i] = err.Error() }
+	return strings.Join(s,"; ")
+}
+// Returns the offsets of the blocks, that outgrew their allocation and must be moved by Relocate().
+func (e EFlush) TooLarge() (offs []int64) {
+	for _,err := range e {
+		if wb,ok := err.(*EWriteBack); ok && wb.Inner==ErrBlockTooLarge { offs = append(offs,wb.Off) }
+	}
+	return
+}
 
 func expand(i []byte,n int) []byte {
 	if cap(i)<n { return make([]byte,n) }
 	return i[:n]
 }
 
+/*
+Copies b to dst, zero-padded to n bytes, like a short read would leave it. The storage of
+dst is reused, if it is large enough. For use in Block.Load().
+*/
+func Fill(dst, b []byte, n int) []byte {
+	if n<len(b) { b = b[:n] }
+	dst = append(dst[:0],b...)
+	if len(dst)<n { dst = append(dst,make([]byte,n-len(dst))...) }
+	return dst
+}
+
 type Block interface{
 	Load(buf *bytebufferpool.ByteBuffer)
 	Store(buf *bytebufferpool.ByteBuffer)
 	Dirty() bool
 }
 
-type NodeMaster struct{
-	Factory func() Block
+// The untyped API: Every block must be type-asserted by the caller.
+type NodeMaster = NodeMasterOf[Block]
+type NodeCache = NodeCacheOf[Block]
+
+const (
+	DefaultCapacity = 1024
+	DefaultShards   = 16
+)
+
+/*
+A NodeMasterOf[T] creates NodeCacheOf[T] instances, that return blocks of the type T.
+*/
+type NodeMasterOf[T Block] struct{
+	Factory func() T
+	
+	/*
+	If non-nil, Relocate() calls Relocated after moving a block, to update the references
+	to the block. Blocks are never moved implicitly: a block, that outgrew its allocation,
+	fails to write back with ErrBlockTooLarge, until it is moved by Relocate().
+	*/
+	Relocated func(c *NodeCacheOf[T], b T, old, new int64) error
+	
+	// The number of blocks per cache and the number of LRU segments it is split into.
+	// Zero means DefaultCapacity and DefaultShards respectively.
+	Capacity int
+	Shards   int
+	
+	/*
+	If set, every stored block is framed with its length and a CRC32C, that is verified on load.
+	Unframed blocks are rejected with ECorrupt, so Checksum must be set when the structure is
+	created, and can't be enabled on an existing file.
+	*/
+	Checksum bool
+	
+	/*
+	If Tag is non-zero, every stored block is prefixed with Tag and the schema Version.
+	Blocks of older versions are decoded with the Decoder registered for (Tag,version),
+	and are written in the current Version, the next time they are written (lazy upgrade).
+	
+	Blocks without a valid prefix (the Tag and a version, that is either Version or has a
+	registered Decoder) are treated as LegacyVersion. Such blocks are written back without
+	prefix, if the prefix doesn't fit into their allocation, but only if LegacyVersion equals
+	Version, or if the block implements LegacyStorer and can be stored as LegacyVersion.
+	*/
+	Tag           uint16
+	Version       uint8
+	LegacyVersion uint8
+	
 	pool    bytebufferpool.Pool
 }
 
-type NodeCache struct{
-	master *NodeMaster
+/*
+A cache of decoded blocks. It is safe for concurrent use, the blocks themselves are not.
+*/
+type NodeCacheOf[T Block] struct{
+	master *NodeMasterOf[T]
 	dman   dataman.DataManager
-	cache  *simplelru.LRU
+	shards []*shard[T]
 	rdonly bool
+	
+	// Serializes all access to the DataManager.
+	io     sync.Mutex
+	
+	/*
+	Incremented with io held, whenever the file is modified. Blocks, that have been read
+	before a modification, are not added to the cache (see shard.addIf()).
+	*/
+	gen    uint64
+	
+	// Failed write-backs during eviction.
+	emutex sync.Mutex
+	errs   []error
+	
+	stats  counters
+	
+	// Set by Subscribe().
+	cancel func()
 }
 
-func (m *NodeMaster) Open(dman dataman.DataManager, rdonly bool) *NodeCache {
-	c := new(NodeCache)
+func (m *NodeMasterOf[T]) Open(dman dataman.DataManager, rdonly bool) *NodeCacheOf[T] {
+	c := new(NodeCacheOf[T])
 	
 	c.master = m
 	c.dman   = dman
 	c.rdonly = rdonly
-	lru,err := simplelru.NewLRU(1024,c.evict)
-	if err!=nil { panic(err) }
-	c.cache  = lru
+	
+	capacity,shards := m.Capacity,m.Shards
+	if capacity<=0 { capacity = DefaultCapacity }
+	if shards<=0 { shards = DefaultShards }
+	per := (capacity+shards-1)/shards
+	c.shards = make([]*shard[T],shards)
+	for i := range c.shards { c.shards[i] = c.newShard(per) }
+	c.stats.capacity = int64(per*shards)
 	
 	return c
 }
-func (c *NodeCache) evict(key interface{}, value interface{}) {
+func (c *NodeCacheOf[T]) shard(off int64) *shard[T] {
+	return c.shards[int(uint64(off>>4)%uint64(len(c.shards)))]
+}
+func (c *NodeCacheOf[T]) newShard(capacity int) *shard[T] {
+	sh := &shard[T]{held:make(map[int64]*entry[T]),stats:&c.stats,gen:&c.gen,write:c.writeVictim}
+	lru,err := simplelru.NewLRU(capacity,func(key interface{}, value interface{}) {
+		c.evict(sh,key.(int64),value.(*entry[T]))
+	})
+	if err!=nil { panic(err) }
+	sh.lru = lru
+	return sh
+}
+
+// Called with sh.mutex held. Dirty blocks are held until sh.unlock() has written them back.
+func (c *NodeCacheOf[T]) evict(sh *shard[T], off int64, e *entry[T]) {
+	if sh.discard { return }
+	if e.pins>0 || e.failed { sh.held[off] = e; return } // Keep it resident.
 	if c.rdonly { return } // Do nothing
-	if !(value.(Block).Dirty()) { return } // Don't store
+	if !e.block.Dirty() { return } // Don't store
+	sh.held[off] = e
+	sh.victims = append(sh.victims,dirtyEntry[T]{off,e})
+}
+// Writes back an evicted block. Failures are reported by the next Flush().
+func (c *NodeCacheOf[T]) writeVictim(off int64, e *entry[T]) error {
+	err := c.writeBack(off,e)
+	if err!=nil {
+		c.emutex.Lock(); defer c.emutex.Unlock()
+		c.errs = append(c.errs,err)
+	}
+	return err
+}
+/*
+Encodes a block. If legacy is set, it is encoded without schema prefix, if that is possible.
+Returns true, if the block has been encoded without schema prefix.
+*/
+func (c *NodeCacheOf[T]) encode(b T, buf *bytebufferpool.ByteBuffer, legacy bool) bool {
+	m := c.master
+	switch {
+	case m.Tag==0: b.Store(buf)
+	case legacy && m.LegacyVersion==m.Version: b.Store(buf)
+	case legacy && storeLegacy(b,buf): // Done.
+	default:
+		legacy = false
+		b.Store(buf)
+		putSchema(buf,m.Tag,m.Version)
+	}
+	if m.Checksum { frame(buf) }
+	return legacy
+}
+/*
+Decodes a block. It returns true, if the block has no schema prefix and
+can be written back without it.
+*/
+func (c *NodeCacheOf[T]) decode(b T, buf *bytebufferpool.ByteBuffer, off int64) (bool,error) {
+	m := c.master
+	orig := buf.B
+	defer func() { buf.B = orig }()
+	if m.Checksum {
+		p,err := unframe(buf.B,off)
+		if err!=nil { return false,err }
+		buf.B = p
+	}
+	if m.Tag==0 { b.Load(buf); return false,nil }
+	
+	tag,version,p,ok := getSchema(buf.B)
+	if ok && tag==m.Tag && (version==m.Version || LookupDecoder(tag,version)!=nil) {
+		buf.B = p
+	} else {
+		ok,version = false,m.LegacyVersion
+	}
+	if version==m.Version {
+		b.Load(buf)
+		return !ok,nil
+	}
+	d := LookupDecoder(m.Tag,version)
+	if d==nil { return false,&ESchema{off,m.Tag,version} }
+	d(b,buf)
+	return !ok,nil
+}
+/*
+Writes a block. It is encoded with c.io held, so the Block can't be cleaned by Store(),
+while the entry is dropped by an event.
+*/
+func (c *NodeCacheOf[T]) writeBack(off int64, e *entry[T]) error {
+	c.io.Lock(); defer c.io.Unlock()
+	if !c.shard(off).holds(off,e) { return nil } // Deleted or invalidated in the meantime.
+	
 	buf := c.master.pool.Get()
 	defer c.master.pool.Put(buf)
-	off := key.(int64)
-	value.(Block).Store(buf)
-	
+	c.encode(e.block,buf,false)
 	size,err := c.dman.UsableSize(off)
-	if err!=nil { return } // Error.
+	if err!=nil { return &EWriteBack{off,err} }
+	
+	legacy := false
+	if int64(len(buf.B))>size && e.legacy {
+		buf.Reset()
+		legacy = c.encode(e.block,buf,true)
+	}
 	
-	if int64(len(buf.B))>size { return } // Error.
+	if int64(len(buf.B))>size { return &EWriteBack{off,ErrBlockTooLarge} }
 	
-	c.dman.RollbackFile().WriteAt(buf.B,off)
+	_,err = c.dman.RollbackFile().WriteAt(buf.B,off)
+	c.modified()
+	if err!=nil { return &EWriteBack{off,err} }
+	e.legacy = legacy
+	c.stats.wrote(len(buf.B))
+	return nil
 }
-func (c *NodeCache) file() file.File {
+// Called with c.io held, after the file has been modified.
+func (c *NodeCacheOf[T]) modified() { atomic.AddUint64(&c.gen,1) }
+func (c *NodeCacheOf[T]) file() file.File {
 	if c.rdonly {
 		return c.dman.DirectFile()
 	} else {
 		return c.dman.RollbackFile()
 	}
 }
-func (c *NodeCache) Delete(off int64) error {
-	c.cache.Remove(off)
+// Returns true, if the cache has been opened read-only.
+func (c *NodeCacheOf[T]) ReadOnly() bool { return c.rdonly }
+/*
+Calls f with exclusive access to the underlying DataManager, for data, that is stored
+alongside the blocks. Read-only caches should only read from dm.DirectFile().
+*/
+func (c *NodeCacheOf[T]) WithDataManager(f func(dm dataman.DataManager) error) error {
+	c.io.Lock(); defer c.io.Unlock()
+	defer c.modified()
+	return f(c.dman)
+}
+func (c *NodeCacheOf[T]) Delete(off int64) error {
+	c.shard(off).remove(off)
+	c.io.Lock(); defer c.io.Unlock()
+	defer c.modified()
 	return c.dman.Free(off)
 }
-func (c *NodeCache) Get(off int64) (Block,error) {
-	b,ok := c.cache.Get(off)
-	if ok { return b.(Block),nil }
-	
-	size,err := c.dman.UsableSize(off)
-	if err!=nil { return nil,err }
+// Reads and decodes a block. Returns the generation of the file, it has been read from.
+func (c *NodeCacheOf[T]) load(off int64) (*entry[T],uint64,error) {
 	buf := c.master.pool.Get()
 	defer c.master.pool.Put(buf)
+	c.io.Lock()
+	err := c.read(off,buf)
+	gen := atomic.LoadUint64(&c.gen)
+	c.io.Unlock()
+	if err!=nil { return nil,0,err }
+	e,err := c.newEntry(off,buf)
+	return e,gen,err
+}
+// Reads the raw block. Called with c.io held.
+func (c *NodeCacheOf[T]) read(off int64, buf *bytebufferpool.ByteBuffer) error {
+	size,err := c.dman.UsableSize(off)
+	if err!=nil { return err }
 	buf.B = expand(buf.B,int(size))
 	_,err = c.file().ReadAt(buf.B,off)
-	if err!=nil { c.master.pool.Put(buf); return nil,err }
-	block := c.master.Factory()
-	block.Load(buf)
-	
-	c.cache.Add(off,block)
-	return block,nil
+	return err
+}
+func (c *NodeCacheOf[T]) newEntry(off int64, buf *bytebufferpool.ByteBuffer) (*entry[T],error) {
+	start := time.Now()
+	e := &entry[T]{block:c.master.Factory(),size:int64(len(buf.B))}
+	legacy,err := c.decode(e.block,buf,off)
+	if err!=nil { return nil,err }
+	e.legacy = legacy
+	c.stats.decoded(len(buf.B),time.Since(start))
+	return e,nil
+}
+func (c *NodeCacheOf[T]) get(off int64, pin bool) (T,error) {
+	sh := c.shard(off)
+	b,ok := sh.get(off,pin)
+	c.stats.hit(ok)
+	for !ok {
+		e,gen,err := c.load(off)
+		if err!=nil { var zero T; return zero,err }
+		
+		// Another goroutine might have loaded the block in the meantime, or modified the file.
+		b,ok = sh.addIf(off,e,pin,gen)
+	}
+	return b,nil
+}
+func (c *NodeCacheOf[T]) Get(off int64) (T,error) {
+	return c.get(off,false)
+}
+
+/*
+Like Get, but pins the block: it stays resident until Unpin() has been called as often
+as Pin(). Pinned blocks are not relocated.
+*/
+func (c *NodeCacheOf[T]) Pin(off int64) (T,error) {
+	return c.get(off,true)
+}
+func (c *NodeCacheOf[T]) Unpin(off int64) {
+	c.shard(off).unpin(off)
 }
-func (c *NodeCache) GetFromCache(off int64) (Block,bool) {
-	b,ok := c.cache.Get(off)
-	if ok { return b.(Block),true }
-	return nil,false
+func (c *NodeCacheOf[T]) GetFromCache(off int64) (T,bool) {
+	return c.shard(off).get(off,false)
 }
-func (c *NodeCache) Set(b Block) (int64,error) {
-	if c.rdonly { return 0,ErrReadOnly } // Do nothing
+func (c *NodeCacheOf[T]) Set(b T) (int64,error) {
+	off,_,err := c.set(b)
+	return off,err
+}
+/*
+Like Set, but b is kept in the cache, so that it can be modified through Pin() without
+being read again. The caller must not use b afterwards, other than through the cache.
+*/
+func (c *NodeCacheOf[T]) Add(b T) (int64,error) {
+	off,size,err := c.set(b)
+	if err!=nil { return 0,err }
+	c.shard(off).offer(off,&entry[T]{block:b,size:size})
+	return off,nil
+}
+func (c *NodeCacheOf[T]) set(b T) (int64,int64,error) {
+	if c.rdonly { return 0,0,ErrReadOnly } // Do nothing
 	buf := c.master.pool.Get()
 	defer c.master.pool.Put(buf)
-	b.Store(buf)
+	c.encode(b,buf,false)
+	c.io.Lock(); defer c.io.Unlock()
 	off,err := c.dman.Alloc(int64(len(buf.B)))
-	if err!=nil { return 0,err }
+	if err!=nil { return 0,0,err }
 	_,err = c.file().WriteAt(buf.B,off)
-	return off,err
+	c.modified()
+	if err==nil { atomic.AddInt64(&c.stats.written,int64(len(buf.B))) }
+	return off,int64(len(buf.B)),err
+}
+/*
+Moves the block at off to a newly allocated location, that is large enough for it,
+and returns the new offset. NodeMaster.Relocated is called, if set.
+*/
+func (c *NodeCacheOf[T]) Relocate(off int64) (int64,error) {
+	if c.rdonly { return 0,ErrReadOnly }
+	sh := c.shard(off)
+	for {
+		_,err := c.Get(off)
+		if err!=nil { return 0,err }
+		sh.mutex.Lock()
+		e := sh.lookup(off)
+		sh.mutex.Unlock()
+		if e!=nil { return c.relocate(off,e) }
+		// Evicted in the meantime.
+	}
+}
+func (c *NodeCacheOf[T]) relocate(off int64, e *entry[T]) (int64,error) {
+	sh := c.shard(off)
+	if !sh.detach(off,e) { return 0,&EWriteBack{off,ErrBlockPinned} }
+	
+	buf := c.master.pool.Get()
+	defer c.master.pool.Put(buf)
+	c.encode(e.block,buf,false)
+	e.legacy = false
+	e.size = int64(len(buf.B))
+	
+	// Store() has cleaned the Block, it is held as failed until it is written.
+	c.io.Lock()
+	noff,err := c.dman.Alloc(int64(len(buf.B)))
+	if err==nil {
+		_,err = c.dman.RollbackFile().WriteAt(buf.B,noff)
+		if err!=nil { c.dman.Free(noff) } else { c.stats.wrote(len(buf.B)) }
+		c.modified()
+	}
+	c.io.Unlock()
+	if err!=nil { return 0,err }
+	
+	sh.drop(off,e)
+	c.shard(noff).insert(noff,e)
+	
+	c.io.Lock()
+	err = c.dman.Free(off)
+	c.modified()
+	c.io.Unlock()
+	if err!=nil { return 0,err }
+	if c.master.Relocated!=nil {
+		err = c.master.Relocated(c,e.block,off,noff)
+	}
+	return noff,err
 }
-func (c *NodeCache) Flush() error {
-	c.cache.Purge()
+// Writes a block and updates its state.
+func (c *NodeCacheOf[T]) flushEntry(sh *shard[T], off int64, e *entry[T]) error {
+	err := c.writeBack(off,e)
+	if err!=nil {
+		sh.fail(off,e)
+	} else {
+		sh.succeed(off,e)
+	}
+	return err
+}
+
+/*
+Writes back all dirty blocks. The blocks stay in the cache.
+
+Blocks, that can't be written, are held in the cache. The errors, including those of failed
+write-backs during eviction, are returned as EFlush.
+*/
+func (c *NodeCacheOf[T]) WriteBack() error {
+	c.emutex.Lock()
+	errs := EFlush(c.errs)
+	c.errs = nil
+	c.emutex.Unlock()
+	if !c.rdonly {
+		for _,sh := range c.shards {
+			for _,d := range sh.dirty(true) {
+				err := c.flushEntry(sh,d.off,d.e)
+				if err!=nil { errs = append(errs,err) }
+			}
+		}
+	}
+	if len(errs)>0 { return errs }
 	return nil
 }
 
+/*
+Writes back all dirty blocks and empties the cache.
+
+Blocks, that can't be written, and pinned blocks stay in the cache. The errors, including
+those of failed write-backs during eviction, are returned as EFlush. Blocks, that outgrew
+their allocation, are reported by EFlush.TooLarge() and must be moved by Relocate().
+*/
+func (c *NodeCacheOf[T]) Flush() error {
+	err := c.WriteBack()
+	for _,sh := range c.shards { sh.purge() }
+	return err
+}
 
+/*
+Subscribes the cache to the commit and rollback events of its DataManager.
+
+A read-only cache drops the blocks, that have been changed by a commit. A writable cache reads
+the RollbackFile(), which isn't changed by a commit, so its blocks survive commits. On rollback
+it discards all modified blocks, the blocks changed by the transaction and the pending
+write-back errors.
+*/
+func (c *NodeCacheOf[T]) Subscribe() {
+	c.emutex.Lock(); defer c.emutex.Unlock()
+	if c.cancel==nil { c.cancel = c.dman.Subscribe(c.changed) }
+}
+func (c *NodeCacheOf[T]) Unsubscribe() {
+	c.emutex.Lock(); defer c.emutex.Unlock()
+	if c.cancel!=nil { c.cancel(); c.cancel = nil }
+}
+func (c *NodeCacheOf[T]) changed(ev dataman.Event) {
+	c.modified()
+	touched := func(off int64, e *entry[T]) bool {
+		return ev.Extents==nil || dataman.Overlaps(ev.Extents,off,e.size)
+	}
+	var f func(off int64, e *entry[T]) bool
+	switch {
+	case c.rdonly && ev.Rollback: return // The DirectFile() is unaffected.
+	case c.rdonly: f = touched
+	case ev.Rollback:
+		f = func(off int64, e *entry[T]) bool {
+			return e.failed || e.block.Dirty() || touched(off,e)
+		}
+		c.emutex.Lock()
+		c.errs = nil
+		c.emutex.Unlock()
+	default: return
+	}
+	for _,sh := range c.shards { sh.invalidate(f) }
+}
+
+// Writes back the dirty blocks and commits the DataManager. The cache is kept.
+func (c *NodeCacheOf[T]) Commit() error {
+	err := c.WriteBack()
+	if err!=nil { return err }
+	c.io.Lock(); defer c.io.Unlock()
+	defer c.modified()
+	return c.dman.Commit()
+}
+
+/*
+Rolls back the DataManager. The cache discards its modified blocks, and if it isn't
+subscribed, all other blocks too.
+*/
+func (c *NodeCacheOf[T]) Rollback() error {
+	c.io.Lock()
+	err := c.dman.Rollback()
+	c.modified()
+	c.io.Unlock()
+	if err!=nil { return err }
+	c.emutex.Lock()
+	subscribed := c.cancel!=nil
+	c.emutex.Unlock()
+	if !subscribed { c.changed(dataman.Event{Rollback:true}) }
+	return nil
+}
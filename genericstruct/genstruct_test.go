@@ -0,0 +1,265 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "os"
+import "testing"
+
+type testBlock struct{
+	Data    []byte
+	Tainted bool
+	
+	// If set, the block can be stored in the legacy version.
+	LegacyOK bool
+}
+func (b *testBlock) Load(buf *bytebufferpool.ByteBuffer) { b.Data = append(b.Data[:0],buf.B...) }
+func (b *testBlock) Store(buf *bytebufferpool.ByteBuffer) {
+	buf.B = append(buf.B,b.Data...)
+	b.Tainted = false
+}
+func (b *testBlock) Dirty() bool { return b.Tainted }
+func (b *testBlock) StoreLegacy(buf *bytebufferpool.ByteBuffer) bool {
+	if !b.LegacyOK { return false }
+	b.Store(buf)
+	return true
+}
+
+func newTestMaster() *NodeMasterOf[*testBlock] {
+	return &NodeMasterOf[*testBlock]{Factory:func() *testBlock { return new(testBlock) }}
+}
+
+func tempFile(t *testing.T) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"genericstruct")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func newDataManager(t *testing.T) dataman.DataManager {
+	dm,err := dataman.NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	return dm
+}
+
+// Reads the block at off through a fresh cache.
+func reread(t *testing.T, m *NodeMasterOf[*testBlock], dm dataman.DataManager, off int64) []byte {
+	b,err := m.Open(dm,true).Get(off)
+	if err!=nil { t.Fatal(err) }
+	return b.Data
+}
+
+func TestFill(t *testing.T) {
+	dst := make([]byte,0,8)
+	got := Fill(dst,[]byte("abcdef"),4)
+	if string(got)!="abcd" || &got[0]!=&dst[:1][0] { t.Fatalf("got %q",got) }
+	got = Fill(got,[]byte("ab"),5)
+	if !bytes.Equal(got,[]byte("ab\x00\x00\x00")) { t.Fatalf("short input: got %q",got) }
+	if got = Fill(nil,nil,0) ; got!=nil { t.Fatalf("got %q",got) }
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	c := m.Open(dm,false)
+	off,err := c.Set(&testBlock{Data:[]byte("hello")})
+	if err!=nil { t.Fatal(err) }
+	b,err := c.Get(off)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.HasPrefix(b.Data,[]byte("hello")) { t.Fatalf("got %q",b.Data) }
+	
+	copy(b.Data,"HELLO")
+	b.Tainted = true
+	if err = c.Flush() ; err!=nil { t.Fatal(err) }
+	if got := reread(t,m,dm,off) ; !bytes.HasPrefix(got,[]byte("HELLO")) { t.Fatalf("got %q",got) }
+}
+
+// Blocks, that outgrew their allocation, are only moved by Relocate().
+func TestRelocateExplicit(t *testing.T) {
+	m := newTestMaster()
+	var moved [2]int64
+	m.Relocated = func(c *NodeCacheOf[*testBlock], b *testBlock, old, new int64) error {
+		moved = [2]int64{old,new}
+		return nil
+	}
+	dm := newDataManager(t)
+	c := m.Open(dm,false)
+	off,err := c.Set(&testBlock{Data:[]byte("small")})
+	if err!=nil { t.Fatal(err) }
+	b,err := c.Get(off)
+	if err!=nil { t.Fatal(err) }
+	b.Data = bytes.Repeat([]byte("large"),100)
+	b.Tainted = true
+	
+	err = c.Flush()
+	ef,ok := err.(EFlush)
+	if !ok || len(ef.TooLarge())!=1 || ef.TooLarge()[0]!=off { t.Fatalf("expected %d to be too large, got %v",off,err) }
+	if moved[0]!=0 { t.Fatal("Flush() relocated the block") }
+	if b2,_ := c.Get(off) ; b2!=b { t.Fatal("the failed block has been dropped") }
+	
+	noff,err := c.Relocate(off)
+	if err!=nil { t.Fatal(err) }
+	if moved!=[2]int64{off,noff} { t.Fatalf("Relocated called with %v, want [%d %d]",moved,off,noff) }
+	if err = c.Flush() ; err!=nil { t.Fatal(err) }
+	if got := reread(t,m,dm,noff) ; !bytes.HasPrefix(got,b.Data) { t.Fatalf("relocated block has %d bytes",len(got)) }
+}
+
+// A dirty block, that fails to write back on eviction, stays resident and is reported by Flush().
+func TestEvictionError(t *testing.T) {
+	m := newTestMaster()
+	m.Capacity = 1
+	m.Shards = 1
+	dm := newDataManager(t)
+	c := m.Open(dm,false)
+	a,err := c.Set(&testBlock{Data:[]byte("a")})
+	if err!=nil { t.Fatal(err) }
+	b,err := c.Set(&testBlock{Data:[]byte("b")})
+	if err!=nil { t.Fatal(err) }
+	
+	blk,err := c.Get(a)
+	if err!=nil { t.Fatal(err) }
+	blk.Data = bytes.Repeat([]byte("a"),1000)
+	blk.Tainted = true
+	if _,err = c.Get(b) ; err!=nil { t.Fatal(err) } // Evicts a.
+	if got,ok := c.GetFromCache(a) ; !ok || got!=blk { t.Fatal("the failed block has been dropped") }
+	
+	err = c.Flush()
+	ef,ok := err.(EFlush)
+	if !ok || len(ef)!=2 { t.Fatalf("expected the eviction and the flush to fail, got %v",err) }
+	for _,e := range ef {
+		if wb,ok := e.(*EWriteBack) ; !ok || wb.Off!=a || wb.Inner!=ErrBlockTooLarge { t.Fatalf("unexpected error %v",e) }
+	}
+	// Errors are only reported once.
+	c.Delete(a)
+	if err = c.Flush() ; err!=nil { t.Fatal(err) }
+}
+
+// The untyped API is the generic one instantiated with Block.
+func TestUntyped(t *testing.T) {
+	m := &NodeMaster{Factory:func() Block { return new(testBlock) }}
+	c := m.Open(newDataManager(t),false)
+	off,err := c.Set(&testBlock{Data:[]byte("untyped")})
+	if err!=nil { t.Fatal(err) }
+	b,err := c.Get(off)
+	if err!=nil { t.Fatal(err) }
+	if tb,ok := b.(*testBlock) ; !ok || !bytes.HasPrefix(tb.Data,[]byte("untyped")) { t.Fatalf("got %#v",b) }
+}
+
+/*
+Evictions (which write back) race with commits (which invalidate with the DataManager held).
+Every goroutine owns its blocks, as blocks themselves are not safe for concurrent use.
+*/
+func TestConcurrent(t *testing.T) {
+	m := newTestMaster()
+	m.Capacity = 8
+	m.Shards = 4
+	dm := newDataManager(t)
+	c := m.Open(dm,false)
+	c.Subscribe()
+	defer c.Unsubscribe()
+	
+	const workers,blocks,rounds = 4,16,200
+	offs := make([][]int64,workers)
+	for w := range offs {
+		for i := 0 ; i<blocks ; i++ {
+			off,err := c.Set(&testBlock{Data:[]byte{0,0}})
+			if err!=nil { t.Fatal(err) }
+			offs[w] = append(offs[w],off)
+		}
+	}
+	
+	stop := make(chan struct{})
+	committed := make(chan error,1)
+	go func() {
+		for {
+			select {
+			case <-stop: committed <- nil; return
+			default:
+			}
+			err := c.WithDataManager(func(dm dataman.DataManager) error { return dm.Commit() })
+			if err!=nil { committed <- err; return }
+		}
+	}()
+	errs := make(chan error,workers)
+	for w := range offs {
+		go func(w int) {
+			for r := 0 ; r<rounds ; r++ {
+				off := offs[w][r%blocks]
+				b,err := c.Pin(off)
+				if err!=nil { errs <- err; return }
+				b.Data[0],b.Data[1] = byte(w),byte(r)
+				b.Tainted = true
+				c.Unpin(off)
+			}
+			errs <- nil
+		}(w)
+	}
+	for range offs {
+		if err := <-errs ; err!=nil { t.Fatal(err) }
+	}
+	close(stop)
+	if err := <-committed ; err!=nil { t.Fatal(err) }
+	if err := c.Flush() ; err!=nil { t.Fatal(err) }
+	
+	for w := range offs {
+		for i,off := range offs[w] {
+			last := byte((rounds-1-i)/blocks*blocks+i)
+			if got := reread(t,m,dm,off) ; got[0]!=byte(w) || got[1]!=last { t.Fatalf("block %d of worker %d: got %v, want [%d %d]",i,w,got[:2],w,last) }
+		}
+	}
+}
+
+// Caches survive commits: the writable one keeps its blocks, the read-only one drops the changed ones.
+func TestCommitKeepsCache(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	w := m.Open(dm,false)
+	r := m.Open(dm,true)
+	w.Subscribe()
+	r.Subscribe()
+	a,err := w.Set(&testBlock{Data:[]byte("a")})
+	if err!=nil { t.Fatal(err) }
+	b,err := w.Set(&testBlock{Data:[]byte("b")})
+	if err==nil { err = w.Commit() }
+	if err!=nil { t.Fatal(err) }
+	
+	ra,err := r.Get(a)
+	if err!=nil { t.Fatal(err) }
+	rb,err := r.Get(b)
+	if err!=nil { t.Fatal(err) }
+	wa,err := w.Get(a)
+	if err!=nil { t.Fatal(err) }
+	wa.Data[0] = 'A'
+	wa.Tainted = true
+	if err = w.Commit() ; err!=nil { t.Fatal(err) }
+	
+	if got,ok := w.GetFromCache(a) ; !ok || got!=wa { t.Fatal("Commit() dropped the writable cache") }
+	if got,ok := r.GetFromCache(b) ; !ok || got!=rb { t.Fatal("the unchanged block has been dropped") }
+	if _,ok := r.GetFromCache(a) ; ok { t.Fatal("the changed block is still cached") }
+	ra,err = r.Get(a)
+	if err!=nil { t.Fatal(err) }
+	if ra.Data[0]!='A' { t.Fatalf("read-only cache got %q",ra.Data) }
+}
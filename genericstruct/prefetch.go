@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package genericstruct
+
+import "github.com/valyala/bytebufferpool"
+import "runtime"
+import "sort"
+import "sync"
+import "sync/atomic"
+
+const DefaultReadAhead = 16
+
+/*
+Loads the blocks at offs into the cache, that aren't cached yet. The blocks are read in one
+batch sorted by offset, and decoded concurrently. Zero offsets are ignored.
+
+Prefetching is a hint: The first error is returned, but all other blocks are cached anyway.
+Blocks are not cached, if the file has been modified after they have been read.
+*/
+func (c *NodeCacheOf[T]) Prefetch(offs []int64) error {
+	var miss []int64
+	for _,off := range offs {
+		if off!=0 && !c.shard(off).has(off) { miss = append(miss,off) }
+	}
+	if len(miss)==0 { return nil }
+	sort.Slice(miss,func(i,j int) bool { return miss[i]<miss[j] })
+	u := miss[:1]
+	for _,off := range miss[1:] {
+		if off!=u[len(u)-1] { u = append(u,off) }
+	}
+	miss = u
+	
+	bufs := make([]*bytebufferpool.ByteBuffer,0,len(miss))
+	errs := make([]error,len(miss))
+	defer func() { for _,buf := range bufs { c.master.pool.Put(buf) } }()
+	c.io.Lock()
+	for i,off := range miss {
+		buf := c.master.pool.Get()
+		bufs = append(bufs,buf)
+		errs[i] = c.read(off,buf)
+	}
+	gen := atomic.LoadUint64(&c.gen)
+	c.io.Unlock()
+	
+	var wg sync.WaitGroup
+	work := make(chan int)
+	workers := runtime.GOMAXPROCS(0)
+	if workers>len(miss) { workers = len(miss) }
+	for w := 0 ; w<workers ; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				e,err := c.newEntry(miss[i],bufs[i])
+				if err==nil { c.shard(miss[i]).offerIf(miss[i],e,gen) }
+				errs[i] = err
+			}
+		}()
+	}
+	var first error
+	for i := range miss {
+		if errs[i]==nil { work <- i } else if first==nil { first = errs[i] }
+	}
+	close(work)
+	wg.Wait()
+	for _,err := range errs {
+		if first==nil { first = err }
+	}
+	return first
+}
+
+/*
+Follows a chain of blocks, starting at off, and loads up to n of them into the cache.
+next returns the successor of a block, or 0 at the end of the chain. It returns the
+successor of the last block loaded.
+
+The chain is followed on private copies of the blocks, read from the file: next may run
+concurrently with other users of the cache, but modifications of cached blocks, that haven't
+been written back, are not seen. Like Prefetch, blocks are not cached, if the file has been
+modified after they have been read.
+*/
+func (c *NodeCacheOf[T]) PrefetchChain(off int64, n int, next func(b T) int64) (int64,error) {
+	for ; n>0 && off!=0 ; n-- {
+		e,gen,err := c.load(off)
+		if err!=nil { return off,err }
+		succ := next(e.block)
+		c.shard(off).offerIf(off,e,gen)
+		off = succ
+	}
+	return off,nil
+}
+
+/*
+Runs PrefetchChain in the background, for iterators over linked blocks.
+
+The iterator calls From() with the successor of every block it visits. Only one chain is
+followed at a time, the next one starts at the end of the previous one, once half of it
+has been visited. The iterator must call Stop() when it is exhausted or closed, so the
+background goroutine doesn't outlive the iteration.
+*/
+type ReadAhead[T Block] struct{
+	Cache *NodeCacheOf[T]
+	N     int // Maximum number of blocks per chain. Zero means DefaultReadAhead, negative disables read-ahead.
+	Next  func(b T) int64
+	done  chan struct{}
+	stop  chan struct{}
+	end   int64
+	steps int
+}
+
+func (r *ReadAhead[T]) From(off int64) {
+	if r.N<0 || off==0 { return }
+	r.steps++
+	if r.done!=nil {
+		select {
+		case <-r.done:
+		default: return
+		}
+	}
+	n := r.N
+	if n==0 { n = DefaultReadAhead }
+	if r.cached(off) {
+		// Within the prefetched range: Continue after it.
+		if r.steps<n/2 || r.end==0 || r.cached(r.end) { return }
+		off = r.end
+	}
+	r.steps = 0
+	done,stop := make(chan struct{}),make(chan struct{})
+	r.done,r.stop = done,stop
+	go func() {
+		defer close(done)
+		var err error
+		for i := 0 ; i<n && off!=0 && err==nil ; i++ {
+			select {
+			case <-stop: r.end = off; return
+			default:
+			}
+			off,err = r.Cache.PrefetchChain(off,1,r.Next)
+		}
+		r.end = off
+	}()
+}
+
+func (r *ReadAhead[T]) cached(off int64) bool { return r.Cache.shard(off).has(off) }
+
+// Waits for the running chain to finish.
+func (r *ReadAhead[T]) Wait() {
+	if r.done!=nil { <-r.done }
+}
+
+// Cancels the running chain and waits for it. A later From() starts over.
+func (r *ReadAhead[T]) Stop() {
+	if r.done==nil { return }
+	close(r.stop)
+	<-r.done
+	r.done,r.stop,r.end,r.steps = nil,nil,0,0
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "encoding/binary"
+import "testing"
+
+// Writes a chain of n blocks, each holding the offset of its successor. Returns the offsets.
+func writeChain(t *testing.T, c *NodeCacheOf[*testBlock], n int) []int64 {
+	offs := make([]int64,n)
+	next := int64(0)
+	for i := n-1 ; i>=0 ; i-- {
+		b := &testBlock{Data:binary.BigEndian.AppendUint64(nil,uint64(next))}
+		off,err := c.Set(b)
+		if err!=nil { t.Fatal(err) }
+		offs[i],next = off,off
+	}
+	return offs
+}
+func chainNext(b *testBlock) int64 { return int64(binary.BigEndian.Uint64(b.Data)) }
+
+func TestPrefetch(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	offs := writeChain(t,m.Open(dm,false),10)
+	c := m.Open(dm,false)
+	if err := c.Prefetch(append([]int64{0,offs[3]},offs...)) ; err!=nil { t.Fatal(err) }
+	if s := c.Stats() ; s.Blocks!=10 || s.Decodes!=10 { t.Fatalf("unexpected %+v",s) }
+	for _,off := range offs {
+		if _,ok := c.GetFromCache(off) ; !ok { t.Fatalf("%d has not been prefetched",off) }
+	}
+}
+
+func TestPrefetchChain(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	offs := writeChain(t,m.Open(dm,false),10)
+	c := m.Open(dm,false)
+	end,err := c.PrefetchChain(offs[0],4,chainNext)
+	if err!=nil { t.Fatal(err) }
+	if end!=offs[4] { t.Fatalf("chain ended at %d, want %d",end,offs[4]) }
+	if s := c.Stats() ; s.Blocks!=4 { t.Fatalf("%d blocks cached, want 4",s.Blocks) }
+}
+
+// Blocks, that have been read before the file was modified, are not cached.
+func TestPrefetchStale(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	c := m.Open(dm,false)
+	offs := writeChain(t,c,2)
+	c.Flush()
+	e,gen,err := c.load(offs[0])
+	if err!=nil { t.Fatal(err) }
+	b,err := c.Get(offs[1])
+	if err!=nil { t.Fatal(err) }
+	b.Tainted = true
+	if err = c.Flush() ; err!=nil { t.Fatal(err) }
+	if c.shard(offs[0]).offerIf(offs[0],e,gen) { t.Fatal("a block read before a write-back has been cached") }
+	if _,ok := c.shard(offs[0]).addIf(offs[0],e,false,gen) ; ok { t.Fatal("a block read before a write-back has been added") }
+	e,gen,err = c.load(offs[0])
+	if err!=nil { t.Fatal(err) }
+	if !c.shard(offs[0]).offerIf(offs[0],e,gen) { t.Fatal("a current block has been refused") }
+}
+
+func TestReadAheadStop(t *testing.T) {
+	m := newTestMaster()
+	dm := newDataManager(t)
+	offs := writeChain(t,m.Open(dm,false),100)
+	c := m.Open(dm,false)
+	r := &ReadAhead[*testBlock]{Cache:c,N:100,Next:chainNext}
+	r.From(offs[0])
+	r.Stop()
+	if r.done!=nil { t.Fatal("Stop() left the chain running") }
+	n := c.Stats().Blocks
+	if n==100 { t.Skip("the chain finished before Stop()") }
+	
+	r.From(offs[0])
+	r.Wait()
+	if c.Stats().Blocks!=100 { t.Fatalf("%d blocks cached after a full chain",c.Stats().Blocks) }
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/valyala/bytebufferpool"
+import "encoding/binary"
+import "fmt"
+import "sync"
+
+// [ 0xFE | Version:1 | Tag:2 ] in front of the encoded block.
+const (
+	schemaMagic = 0xFE
+	schemaHead  = 4
+)
+
+type ESchema struct{
+	Off     int64
+	Tag     uint16
+	Version uint8
+}
+func (e *ESchema) Error() string {
+	return fmt.Sprintf("Unknown block schema at %d: tag %04x version %d",e.Off,e.Tag,e.Version)
+}
+
+// Decodes a block, that has been stored in an older schema version, into the current structure.
+type Decoder func(b Block, buf *bytebufferpool.ByteBuffer)
+
+type schemaKey struct{
+	tag     uint16
+	version uint8
+}
+
+var registry = struct{
+	sync.RWMutex
+	m map[schemaKey]Decoder
+}{m:make(map[schemaKey]Decoder)}
+
+// Registers the decoder of the given block type and schema version.
+func RegisterDecoder(tag uint16, version uint8, d Decoder) {
+	registry.Lock(); defer registry.Unlock()
+	registry.m[schemaKey{tag,version}] = d
+}
+func LookupDecoder(tag uint16, version uint8) Decoder {
+	registry.RLock(); defer registry.RUnlock()
+	return registry.m[schemaKey{tag,version}]
+}
+
+func putSchema(buf *bytebufferpool.ByteBuffer, tag uint16, version uint8) {
+	n := len(buf.B)
+	var head [schemaHead]byte
+	buf.B = append(buf.B,head[:]...)
+	copy(buf.B[schemaHead:],buf.B[:n])
+	buf.B[0] = schemaMagic
+	buf.B[1] = version
+	binary.BigEndian.PutUint16(buf.B[2:],tag)
+}
+
+/*
+Implemented by blocks, whose encoding has changed in a backwards compatible way. StoreLegacy
+encodes the block in the legacy version (see NodeMasterOf.LegacyVersion) and returns true,
+or returns false without modifying buf, if the block can't be represented in it.
+*/
+type LegacyStorer interface{
+	StoreLegacy(buf *bytebufferpool.ByteBuffer) bool
+}
+
+func storeLegacy(b Block, buf *bytebufferpool.ByteBuffer) bool {
+	ls,ok := b.(LegacyStorer)
+	return ok && ls.StoreLegacy(buf)
+}
+
+/*
+Splits the schema header off b. Legacy blocks without header are told apart by the caller:
+they must not begin with a valid header of their tag.
+*/
+func getSchema(b []byte) (tag uint16,version uint8,payload []byte,ok bool) {
+	if len(b)<schemaHead || b[0]!=schemaMagic { return 0,0,b,false }
+	return binary.BigEndian.Uint16(b[2:]),b[1],b[schemaHead:],true
+}
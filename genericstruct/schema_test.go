@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "testing"
+
+const testTag = 0x5453
+
+func init() {
+	RegisterDecoder(testTag,1,func(b Block, buf *bytebufferpool.ByteBuffer) { b.(*testBlock).Load(buf) })
+}
+
+func newSchemaMaster() *NodeMasterOf[*testBlock] {
+	m := newTestMaster()
+	m.Tag,m.Version,m.LegacyVersion = testTag,2,1
+	return m
+}
+
+// Writes a block without schema prefix, that fills its allocation.
+func writeLegacy(t *testing.T, dm dataman.DataManager, head ...byte) (int64,[]byte) {
+	off,err := dm.Alloc(20)
+	if err!=nil { t.Fatal(err) }
+	size,err := dm.UsableSize(off)
+	if err!=nil { t.Fatal(err) }
+	data := append(head,bytes.Repeat([]byte{'x'},int(size)-len(head))...)
+	_,err = dm.RollbackFile().WriteAt(data,off)
+	if err!=nil { t.Fatal(err) }
+	return off,data
+}
+
+func TestSchemaPrefix(t *testing.T) {
+	m := newSchemaMaster()
+	dm := newDataManager(t)
+	off,err := m.Open(dm,false).Set(&testBlock{Data:[]byte("current")})
+	if err!=nil { t.Fatal(err) }
+	raw := make([]byte,schemaHead)
+	_,err = dm.RollbackFile().ReadAt(raw,off)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(raw,[]byte{schemaMagic,2,0x54,0x53}) { t.Fatalf("unexpected prefix %x",raw) }
+	if got := reread(t,m,dm,off) ; !bytes.HasPrefix(got,[]byte("current")) { t.Fatalf("got %q",got) }
+}
+
+/*
+A legacy block, whose prefix doesn't fit into its allocation, is only written back without
+prefix, if it can be represented in the legacy version.
+*/
+func TestSchemaLegacyWrite(t *testing.T) {
+	m := newSchemaMaster()
+	dm := newDataManager(t)
+	off,data := writeLegacy(t,dm)
+	c := m.Open(dm,false)
+	b,err := c.Get(off)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(b.Data,data) { t.Fatalf("got %q",b.Data) }
+	
+	b.Data[0] = 'y'
+	b.Tainted = true
+	err = c.Flush()
+	if ef,ok := err.(EFlush) ; !ok || len(ef.TooLarge())!=1 { t.Fatalf("expected ErrBlockTooLarge, got %v",err) }
+	
+	b.LegacyOK = true
+	b.Tainted = true
+	if err = c.Flush() ; err!=nil { t.Fatal(err) }
+	raw := make([]byte,len(data))
+	_,err = dm.RollbackFile().ReadAt(raw,off)
+	if err!=nil { t.Fatal(err) }
+	if raw[0]!='y' || !bytes.Equal(raw[1:],data[1:]) { t.Fatalf("expected the legacy encoding, got %q",raw) }
+}
+
+// Only the prefix of a known version with the right tag is recognized as such.
+func TestSchemaForgedPrefix(t *testing.T) {
+	m := newSchemaMaster()
+	dm := newDataManager(t)
+	for _,head := range [][]byte{
+		{schemaMagic,2,0x12,0x34}, // Other tag
+		{schemaMagic,9,0x54,0x53}, // Unknown version
+	} {
+		off,data := writeLegacy(t,dm,head...)
+		if got := reread(t,m,dm,off) ; !bytes.Equal(got,data) { t.Fatalf("%x: got %q",head,got) }
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "github.com/hashicorp/golang-lru/simplelru"
+import "sync"
+import "sync/atomic"
+
+type entry[T Block] struct{
+	block  T
+	pins   int
+	failed bool // The last write-back failed.
+	legacy bool // The block has been stored without schema prefix.
+	size   int64 // The number of bytes the block occupies in the file.
+}
+
+type dirtyEntry[T Block] struct{
+	off int64
+	e   *entry[T]
+}
+
+/*
+A segment of the cache. Entries, that have been evicted from the LRU while being pinned,
+while waiting for their write-back or after their write-back failed, are kept in held.
+
+No I/O is done with the mutex held: evicted dirty entries are queued in victims, and
+written back by unlock(), after the mutex has been released. The lock order is
+NodeCacheOf.io before shard.mutex.
+*/
+type shard[T Block] struct{
+	mutex   sync.Mutex
+	lru     *simplelru.LRU
+	held    map[int64]*entry[T]
+	victims []dirtyEntry[T]
+	stats   *counters
+	gen     *uint64
+	write   func(off int64, e *entry[T]) error
+	
+	// Set while entries are removed, that must not be written back.
+	discard bool
+}
+
+/*
+Releases the mutex and writes back the queued victims. Used by the methods, that add
+entries to the LRU, which must not be called with NodeCacheOf.io held.
+*/
+func (s *shard[T]) unlock() {
+	for len(s.victims)>0 {
+		d := s.victims[0]
+		s.victims = s.victims[1:]
+		s.mutex.Unlock()
+		err := s.write(d.off,d.e)
+		s.mutex.Lock()
+		s.written(d.off,d.e,err)
+	}
+	s.mutex.Unlock()
+}
+// Called with mutex held, after a victim has been written back.
+func (s *shard[T]) written(off int64, e *entry[T], err error) {
+	if s.held[off]!=e { return } // Deleted or invalidated in the meantime.
+	if err!=nil { e.failed = true; return }
+	if e.pins>0 || e.failed { return }
+	delete(s.held,off)
+	if e.block.Dirty() { s.push(off,e) } // Modified in the meantime.
+}
+// Reports, whether e is the current entry of off, without affecting the LRU order.
+func (s *shard[T]) holds(off int64, e *entry[T]) bool {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	if v,ok := s.lru.Peek(off); ok { return v.(*entry[T])==e }
+	return s.held[off]==e
+}
+
+// Called with mutex held.
+func (s *shard[T]) lookup(off int64) *entry[T] {
+	if v,ok := s.lru.Get(off); ok { return v.(*entry[T]) }
+	return s.held[off]
+}
+func (s *shard[T]) push(off int64, e *entry[T]) {
+	if s.lru.Add(off,e) { s.stats.evicted(1) }
+}
+func (s *shard[T]) get(off int64, pin bool) (T,bool) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	e := s.lookup(off)
+	if e==nil { var zero T; return zero,false }
+	if pin { e.pins++ }
+	return e.block,true
+}
+/*
+Adds ne, unless the block is cached already, and returns the cached block. If the block
+isn't cached and the file has been modified since generation gen, nothing is added and
+false is returned.
+*/
+func (s *shard[T]) addIf(off int64, ne *entry[T], pin bool, gen uint64) (T,bool) {
+	s.mutex.Lock(); defer s.unlock()
+	e := s.lookup(off)
+	if e==nil {
+		if atomic.LoadUint64(s.gen)!=gen { var zero T; return zero,false }
+		e = ne
+		s.push(off,e)
+	}
+	if pin { e.pins++ }
+	return e.block,true
+}
+// Adds e, unless the block is cached already. Returns true, if e has been added.
+func (s *shard[T]) offer(off int64, e *entry[T]) bool {
+	s.mutex.Lock(); defer s.unlock()
+	if s.lookup(off)!=nil { return false }
+	s.push(off,e)
+	return true
+}
+// Like offer, but only if the file hasn't been modified since generation gen.
+func (s *shard[T]) offerIf(off int64, e *entry[T], gen uint64) bool {
+	s.mutex.Lock(); defer s.unlock()
+	if s.lookup(off)!=nil || atomic.LoadUint64(s.gen)!=gen { return false }
+	s.push(off,e)
+	return true
+}
+// Reports, whether the block is cached, without affecting the LRU order.
+func (s *shard[T]) has(off int64) bool {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	return s.lru.Contains(off) || s.held[off]!=nil
+}
+func (s *shard[T]) insert(off int64, e *entry[T]) {
+	s.mutex.Lock(); defer s.unlock()
+	e.failed = false
+	s.push(off,e)
+}
+func (s *shard[T]) unpin(off int64) {
+	s.mutex.Lock(); defer s.unlock()
+	e := s.lookup(off)
+	if e==nil || e.pins==0 { return }
+	e.pins--
+	if e.pins==0 && !e.failed && s.held[off]==e {
+		delete(s.held,off)
+		s.push(off,e)
+	}
+}
+// Takes an unpinned entry out of the LRU, and holds it as failed.
+func (s *shard[T]) detach(off int64, e *entry[T]) bool {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	if e.pins>0 { return false }
+	e.failed = true
+	s.lru.Remove(off)
+	s.held[off] = e
+	return true
+}
+func (s *shard[T]) drop(off int64, e *entry[T]) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	if s.held[off]==e { delete(s.held,off) }
+}
+func (s *shard[T]) fail(off int64, e *entry[T]) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	e.failed = true
+	s.lru.Remove(off)
+	s.held[off] = e
+}
+func (s *shard[T]) succeed(off int64, e *entry[T]) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	if !e.failed { return }
+	e.failed = false
+	if s.held[off]==e && e.pins==0 { delete(s.held,off) }
+}
+// Returns the entries, that need to be written. Failed entries are only included if withFailed is set.
+func (s *shard[T]) dirty(withFailed bool) (d []dirtyEntry[T]) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	for off,e := range s.held {
+		if e.block.Dirty() || (withFailed && e.failed) { d = append(d,dirtyEntry[T]{off,e}) }
+	}
+	for _,key := range s.lru.Keys() {
+		v,_ := s.lru.Peek(key)
+		e := v.(*entry[T])
+		if e.block.Dirty() { d = append(d,dirtyEntry[T]{key.(int64),e}) }
+	}
+	return
+}
+// Empties the LRU. Dirty entries are written back.
+func (s *shard[T]) purge() {
+	s.mutex.Lock(); defer s.unlock()
+	s.lru.Purge()
+}
+// Removes an entry without writing it back.
+func (s *shard[T]) remove(off int64) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	s.discard = true
+	s.lru.Remove(off)
+	s.discard = false
+	delete(s.held,off)
+}
+// Drops the entries, for which f returns true, without writing them back.
+func (s *shard[T]) invalidate(f func(off int64, e *entry[T]) bool) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	s.discard = true
+	for _,key := range s.lru.Keys() {
+		v,_ := s.lru.Peek(key)
+		if f(key.(int64),v.(*entry[T])) { s.lru.Remove(key) }
+	}
+	s.discard = false
+	for off,e := range s.held {
+		if f(off,e) { delete(s.held,off) }
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package genericstruct
+
+import "expvar"
+import "sync/atomic"
+import "time"
+
+/*
+Statistics of a NodeCacheOf[T]. Evictions only counts blocks, that were pushed out
+of the LRU by newer ones, not those removed by Flush() or Delete().
+*/
+type Stats struct{
+	Hits, Misses int64
+	Evictions    int64
+	Writebacks   int64 // Dirty blocks written to the file.
+	
+	BytesRead    int64
+	BytesWritten int64
+	
+	Decodes      int64
+	DecodeTime   time.Duration // Total time spent decoding blocks.
+	
+	Blocks       int // Blocks currently in the cache.
+	Capacity     int
+}
+func (s Stats) AvgDecodeTime() time.Duration {
+	if s.Decodes==0 { return 0 }
+	return s.DecodeTime/time.Duration(s.Decodes)
+}
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses==0 { return 0 }
+	return float64(s.Hits)/float64(s.Hits+s.Misses)
+}
+
+type counters struct{
+	hits, misses, evictions, writebacks int64
+	read, written                       int64
+	decodes, decodeTime                 int64
+	capacity                            int64
+}
+func (s *counters) hit(ok bool) {
+	if ok { atomic.AddInt64(&s.hits,1) } else { atomic.AddInt64(&s.misses,1) }
+}
+func (s *counters) evicted(n int) { if n>0 { atomic.AddInt64(&s.evictions,int64(n)) } }
+func (s *counters) wrote(n int) {
+	atomic.AddInt64(&s.writebacks,1)
+	atomic.AddInt64(&s.written,int64(n))
+}
+func (s *counters) decoded(n int, d time.Duration) {
+	atomic.AddInt64(&s.read,int64(n))
+	atomic.AddInt64(&s.decodes,1)
+	atomic.AddInt64(&s.decodeTime,int64(d))
+}
+
+func (c *NodeCacheOf[T]) Stats() (s Stats) {
+	st := &c.stats
+	s.Hits         = atomic.LoadInt64(&st.hits)
+	s.Misses       = atomic.LoadInt64(&st.misses)
+	s.Evictions    = atomic.LoadInt64(&st.evictions)
+	s.Writebacks   = atomic.LoadInt64(&st.writebacks)
+	s.BytesRead    = atomic.LoadInt64(&st.read)
+	s.BytesWritten = atomic.LoadInt64(&st.written)
+	s.Decodes      = atomic.LoadInt64(&st.decodes)
+	s.DecodeTime   = time.Duration(atomic.LoadInt64(&st.decodeTime))
+	s.Capacity     = int(atomic.LoadInt64(&st.capacity))
+	for _,sh := range c.shards {
+		sh.mutex.Lock()
+		s.Blocks += sh.lru.Len()+len(sh.held)
+		sh.mutex.Unlock()
+	}
+	return
+}
+
+/*
+Publishes the statistics of the cache as the expvar variable name.
+Like expvar.Publish, it panics if name is already in use.
+*/
+func (c *NodeCacheOf[T]) Publish(name string) {
+	expvar.Publish(name,expvar.Func(func() interface{} { return c.Stats() }))
+}
+
+/*
+Changes the number of blocks the cache holds. Shrinking the cache evicts (and writes back)
+the least recently used blocks. Write-back errors are reported by the next Flush().
+*/
+func (c *NodeCacheOf[T]) Resize(capacity int) {
+	if capacity<=0 { capacity = DefaultCapacity }
+	per := (capacity+len(c.shards)-1)/len(c.shards)
+	atomic.StoreInt64(&c.stats.capacity,int64(per*len(c.shards)))
+	for _,sh := range c.shards {
+		sh.mutex.Lock()
+		c.stats.evicted(sh.lru.Resize(per))
+		sh.unlock()
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package genericstruct
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	m := newTestMaster()
+	m.Capacity,m.Shards = 2,1
+	c := m.Open(newDataManager(t),false)
+	var offs []int64
+	for i := 0 ; i<3 ; i++ {
+		off,err := c.Set(&testBlock{Data:[]byte{byte(i)}})
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,off)
+	}
+	for _,off := range append(offs,offs[2]) {
+		b,err := c.Get(off)
+		if err!=nil { t.Fatal(err) }
+		b.Tainted = true
+	}
+	s := c.Stats()
+	if s.Hits!=1 || s.Misses!=3 { t.Fatalf("expected 1 hit and 3 misses, got %+v",s) }
+	if s.Evictions!=1 || s.Writebacks!=1 { t.Fatalf("expected 1 eviction with write-back, got %+v",s) }
+	if s.Blocks!=2 || s.Capacity!=2 || s.Decodes!=3 { t.Fatalf("unexpected %+v",s) }
+	
+	c.Resize(1)
+	s = c.Stats()
+	if s.Blocks!=1 || s.Capacity!=1 || s.Evictions!=2 || s.Writebacks!=2 { t.Fatalf("after Resize(1): %+v",s) }
+	if s.HitRatio()!=0.25 { t.Fatalf("hit ratio %v",s.HitRatio()) }
+}
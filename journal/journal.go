@@ -116,6 +116,7 @@ func (j *JournalFile) ReadAt(p []byte, off int64) (n int, err error) {
 		if int64(n)<cut {
 			if cut<int64(len(p)) {
 				bzero(p[n:int(cut)])
+				n = int(cut)
 			} else {
 				bzero(p[n:])
 				n = len(p)
@@ -164,6 +165,10 @@ func (j *JournalFile) Commit(rws WAL_Target) error {
 	j.overlay.ClearJournal()
 	return nil
 }
+// Discards all changes since the last Commit().
+func (j *JournalFile) Rollback() {
+	j.overlay.ClearJournal()
+}
 func (j *JournalFile) String() string {
 	return fmt.Sprint(j.overlay)
 }
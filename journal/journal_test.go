@@ -0,0 +1,71 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package journal
+
+import "github.com/maxymania/gobase/dataman"
+import "bytes"
+import "io"
+import "os"
+import "testing"
+
+func tempFile(t *testing.T) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"journal")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// Reading across the end of the file into a range, that only exists in the overlay.
+func TestJournalFileReadGrown(t *testing.T) {
+	j,err := OpenJournalFile(tempFile(t),tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	_,err = j.WriteAt([]byte("tail"),100)
+	if err!=nil { t.Fatal(err) }
+	p := make([]byte,200)
+	n,err := j.ReadAt(p,0)
+	if n!=104 { t.Fatalf("got %d bytes (%v), want 104",n,err) }
+	if err!=io.EOF { t.Fatalf("expected io.EOF, got %v",err) }
+	if !bytes.Equal(p[100:104],[]byte("tail")) || !bytes.Equal(p[:100],make([]byte,100)) { t.Fatalf("got %q",p[:104]) }
+}
+
+// Rollback() reloads the AlignedTable together with the allocator.
+func TestJournalAlignedRollback(t *testing.T) {
+	j,err := NewJournalDataManager(tempFile(t),tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	root,err := dataman.NewAlignedRoot(j)
+	if err==nil { err = j.Commit() }
+	if err==nil { err = j.UseAlignedTable(root) }
+	if err!=nil { t.Fatal(err) }
+	
+	kept,err := j.AllocAligned(100,1024)
+	if err==nil { err = j.Commit() }
+	if err!=nil { t.Fatal(err) }
+	n := j.table.Len()
+	for i := 0 ; i<4 ; i++ {
+		_,err = j.AllocAligned(100,1024)
+		if err!=nil { t.Fatal(err) }
+	}
+	if err = j.Rollback() ; err!=nil { t.Fatal(err) }
+	if j.table.Len()!=n { t.Fatalf("%d table entries after Rollback(), want %d",j.table.Len(),n) }
+	if err = j.Free(kept) ; err!=nil { t.Fatal(err) }
+}
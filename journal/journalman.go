@@ -24,6 +24,8 @@ SOFTWARE.
 package journal
 
 import "github.com/cznic/file"
+import "github.com/maxymania/gobase/dataman"
+import "math"
 
 /*
 Close() error
@@ -31,16 +33,23 @@ DirectFile() file.File
 RollbackFile() file.File
 
 Alloc(size int64) (int64, error)
+AllocAligned(size, align int64) (int64, error)
+AllocAtLeast(size int64) (int64, int64, error)
 Free(off int64) error
 UsableSize(off int64) (int64, error)
+Footprint(off int64) (int64, error)
 Commit() error
+Rollback() error
+Subscribe(l dataman.Listener) (cancel func())
 */
 
 type JournalDataManager struct{
+	dataman.Events
 	wal    WAL_Target
 	jfile  *JournalFile
 	dfile  file.File
 	alloc  *file.Allocator
+	table  *dataman.AlignedTable
 }
 func NewJournalDataManager(f file.File, w WAL_Target) (*JournalDataManager,error) {
 	j,err := OpenJournalFile(f,w)
@@ -49,14 +58,56 @@ func NewJournalDataManager(f file.File, w WAL_Target) (*JournalDataManager,error
 	if err!=nil { return nil,err }
 	err = j.Commit(w)
 	if err!=nil { return nil,err }
-	return &JournalDataManager{w,j,f,a},nil
+	return &JournalDataManager{wal:w,jfile:j,dfile:f,alloc:a},nil
+}
+// Opens the AlignedTable at root (see dataman.NewAlignedRoot()). Must be called after every reopen.
+func (j *JournalDataManager) UseAlignedTable(root int64) error {
+	t,err := dataman.OpenAlignedTable(j.alloc,j.jfile,root)
+	if err!=nil { return err }
+	j.table = t
+	return nil
 }
 func (j *JournalDataManager) Close() error { return j.dfile.Close() }
 func (j *JournalDataManager) DirectFile() file.File { return j.dfile }
 func (j *JournalDataManager) RollbackFile() file.File { return j.jfile }
 
 func (j *JournalDataManager) Alloc(size int64) (int64, error) { return j.alloc.Alloc(size) }
-func (j *JournalDataManager) Free(off int64) error { return j.alloc.Free(off) }
-func (j *JournalDataManager) UsableSize(off int64) (int64, error) { return j.alloc.UsableSize(off) }
-func (j *JournalDataManager) Commit() error { return j.jfile.Commit(j.wal) }
+func (j *JournalDataManager) AllocAligned(size, align int64) (int64, error) { return dataman.AlignedAlloc(j.alloc,j.table,size,align) }
+func (j *JournalDataManager) AllocAtLeast(size int64) (int64, int64, error) { return dataman.AllocAtLeast(j,size) }
+func (j *JournalDataManager) Free(off int64) error { return dataman.AlignedFree(j.alloc,j.table,off) }
+func (j *JournalDataManager) UsableSize(off int64) (int64, error) { return dataman.AlignedUsableSize(j.alloc,j.table,off) }
+func (j *JournalDataManager) Footprint(off int64) (int64, error) { return dataman.AlignedFootprint(j.alloc,j.table,off) }
+func (j *JournalDataManager) Commit() error {
+	ext := j.extents()
+	err := j.jfile.Commit(j.wal)
+	if err!=nil { return err }
+	j.Emit(dataman.Event{Extents:ext})
+	return nil
+}
+/*
+Discards all changes since the last Commit(). The allocator is reopened and the AlignedTable
+is reloaded, as their state might have changed as well.
+*/
+func (j *JournalDataManager) Rollback() error {
+	ext := j.extents()
+	j.jfile.Rollback()
+	a,err := file.NewAllocator(j.jfile)
+	if err!=nil { return err }
+	j.alloc = a
+	if j.table!=nil {
+		err = j.table.Reload(a)
+		if err!=nil { return err }
+	}
+	j.Emit(dataman.Event{Rollback:true,Extents:ext})
+	return nil
+}
+// The changed ranges of the overlay, sorted and merged. The result is never nil.
+func (j *JournalDataManager) extents() []dataman.Extent {
+	var ext []dataman.Extent
+	j.jfile.overlay.Extents(func(off, n int64) {
+		if n<0 { n = math.MaxInt64-off }
+		ext = append(ext,dataman.Extent{Off:off,Len:n})
+	})
+	return dataman.MergeExtents(ext)
+}
 func (j *JournalDataManager) GetWalSize() int64 { return j.jfile.GetWalSize() }
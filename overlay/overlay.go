@@ -263,3 +263,16 @@ func (o *Overlay) ClearJournal() {
 }
 
 
+
+/*
+Calls f for every range, that has been written, in ascending order. If the file has
+been truncated, the range from the new size to the end is reported last, with n<0.
+*/
+func (o *Overlay) Extents(f func(off, n int64)) {
+	o.sl.Ascend(func (i btree.Item) bool {
+		ne := i.(*item)
+		f(ne.offset,int64(len(ne.data)))
+		return true
+	})
+	if o.truncate { f(o.fileSize,-1) }
+}
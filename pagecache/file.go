@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pagecache
+
+import "github.com/cznic/file"
+import "github.com/maxymania/gobase/dataman"
+import "os"
+
+/*
+A file-Wrapper that routes all reads and writes through a Pool.
+*/
+type File struct{
+	file.File
+	Pool *Pool
+}
+func NewFile(f file.File, npages int) *File {
+	return &File{f,NewPool(f,npages)}
+}
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) { return f.Pool.ReadAt(p,off) }
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) { return f.Pool.WriteAt(p,off) }
+func (f *File) Truncate(i int64) error {
+	err := f.Pool.Clip(i)
+	if err!=nil { return err }
+	err = f.File.Truncate(i)
+	if err!=nil { return err }
+	return f.Pool.InvalidateAll()
+}
+func (f *File) Stat() (os.FileInfo, error) {
+	err := f.Pool.Flush()
+	if err!=nil { return nil,err }
+	return f.File.Stat()
+}
+func (f *File) Sync() error {
+	err := f.Pool.Flush()
+	if err!=nil { return err }
+	return f.File.Sync()
+}
+func (f *File) Close() error {
+	err := f.Pool.Flush()
+	if err!=nil { return err }
+	return f.File.Close()
+}
+
+/*
+A DataManager-Wrapper, that puts a page buffer pool in front of the DirectFile()
+and the RollbackFile() of the underlying DataManager.
+*/
+type DataManager struct{
+	dataman.DataManager
+	direct   *File
+	rollback *File
+	cancel   func()
+}
+func NewDataManager(dm dataman.DataManager, npages int) *DataManager {
+	d := &DataManager{DataManager:dm}
+	d.rollback = NewFile(dm.RollbackFile(),npages)
+	if dm.DirectFile()==dm.RollbackFile() {
+		d.direct = d.rollback
+	} else {
+		d.direct = NewFile(dm.DirectFile(),npages)
+	}
+	// Subscribed first, so the pools are up to date, when other listeners are called.
+	d.cancel = dm.Subscribe(d.changed)
+	return d
+}
+func (d *DataManager) changed(ev dataman.Event) {
+	if ev.Rollback {
+		d.rollback.Pool.Discard()
+		return
+	}
+	if d.direct==d.rollback { return }
+	if ev.Extents==nil {
+		d.direct.Pool.InvalidateAll()
+		return
+	}
+	for _,e := range ev.Extents { d.direct.Pool.Invalidate(e.Off,e.Len) }
+}
+func (d *DataManager) DirectFile() file.File { return d.direct }
+func (d *DataManager) RollbackFile() file.File { return d.rollback }
+
+// The allocator modifies the file by-passing the pool, so the affected pages must be dropped.
+func (d *DataManager) invalidate(off int64) error {
+	size,err := d.DataManager.UsableSize(off)
+	if err!=nil { return err }
+	err = d.rollback.Pool.Invalidate(off,size)
+	if err!=nil { return err }
+	if d.direct!=d.rollback {
+		err = d.direct.Pool.Invalidate(off,size)
+	}
+	return err
+}
+func (d *DataManager) Alloc(size int64) (int64, error) {
+	off,err := d.DataManager.Alloc(size)
+	if err!=nil { return 0,err }
+	return off,d.invalidate(off)
+}
+func (d *DataManager) AllocAligned(size, align int64) (int64, error) {
+	off,err := d.DataManager.AllocAligned(size,align)
+	if err!=nil { return 0,err }
+	return off,d.invalidate(off)
+}
+func (d *DataManager) AllocAtLeast(size int64) (int64, int64, error) {
+	return dataman.AllocAtLeast(d,size)
+}
+func (d *DataManager) Free(off int64) error {
+	err := d.invalidate(off)
+	if err!=nil { return err }
+	return d.DataManager.Free(off)
+}
+func (d *DataManager) Commit() error {
+	err := d.rollback.Pool.Flush()
+	if err!=nil { return err }
+	return d.DataManager.Commit()
+}
+// The pool is flushed first, so the rollback event covers its modifications.
+func (d *DataManager) Rollback() error {
+	err := d.rollback.Pool.Flush()
+	if err!=nil { return err }
+	return d.DataManager.Rollback()
+}
+// Unsubscribes the pools from the underlying DataManager, before closing it.
+func (d *DataManager) Close() error {
+	d.cancel()
+	err := d.rollback.Pool.Flush()
+	if err!=nil { return err }
+	return d.DataManager.Close()
+}
+
+// Returns the combined statistics of all pools.
+func (d *DataManager) Stats() Stats {
+	s := d.rollback.Pool.Stats()
+	if d.direct!=d.rollback {
+		o := d.direct.Pool.Stats()
+		s.Hits       += o.Hits
+		s.Misses     += o.Misses
+		s.Evictions  += o.Evictions
+		s.Writebacks += o.Writebacks
+	}
+	return s
+}
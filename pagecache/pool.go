@@ -0,0 +1,312 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pagecache
+
+import "github.com/cznic/file"
+import "errors"
+import "sync"
+import "io"
+
+const PageSize = 4096
+
+var EPoolExhausted = errors.New("Page pool exhausted (all pages pinned)")
+
+type Stats struct{
+	Hits, Misses   int64
+	Evictions      int64
+	Writebacks     int64
+}
+
+/*
+A Page is a fixed-size frame of the Pool. Data is only valid while the page is pinned.
+*/
+type Page struct{
+	Data    [PageSize]byte
+	num     int64
+	valid   int  // number of bytes backed by the file (or written)
+	pins    int
+	ref     bool // clock reference bit
+	dlo,dhi int  // dirty range (dlo==dhi means clean)
+}
+func (p *Page) Num() int64 { return p.num }
+func (p *Page) Dirty() bool { return p.dlo!=p.dhi }
+
+/*
+A fixed-size page buffer pool in front of a file using the clock replacement algorithm.
+
+Dirty pages are tracked per byte range, and only the ranges, that have actually been written,
+are written back. This allows the pool to be used on files, that are also modified by others
+(such as the allocator), as long as they don't modify the same bytes.
+*/
+type Pool struct{
+	mutex  sync.Mutex
+	f      file.File
+	frames []*Page
+	index  map[int64]*Page
+	max    int
+	hand   int
+	stats  Stats
+}
+func NewPool(f file.File, npages int) *Pool {
+	if npages<1 { npages = 1 }
+	return &Pool{f:f,index:make(map[int64]*Page),max:npages}
+}
+func (p *Pool) Stats() Stats {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	return p.stats
+}
+func (p *Pool) writeBack(pg *Page) error {
+	if !pg.Dirty() { return nil }
+	_,err := p.f.WriteAt(pg.Data[pg.dlo:pg.dhi],pg.num*PageSize+int64(pg.dlo))
+	if err!=nil { return err }
+	pg.dlo,pg.dhi = 0,0
+	p.stats.Writebacks++
+	return nil
+}
+func (p *Pool) frame() (*Page,error) {
+	if len(p.frames)<p.max {
+		pg := new(Page)
+		p.frames = append(p.frames,pg)
+		return pg,nil
+	}
+	for i,n := 0,len(p.frames)*2 ; i<n ; i++ {
+		pg := p.frames[p.hand]
+		p.hand = (p.hand+1)%len(p.frames)
+		if pg.pins>0 { continue }
+		if pg.ref { pg.ref = false; continue }
+		if pg.num>=0 {
+			if cur,ok := p.index[pg.num]; ok && cur==pg {
+				err := p.writeBack(pg)
+				if err!=nil { return nil,err }
+				delete(p.index,pg.num)
+				p.stats.Evictions++
+			}
+		}
+		return pg,nil
+	}
+	return nil,EPoolExhausted
+}
+func (p *Pool) pin(num int64, load bool) (*Page,error) {
+	if pg,ok := p.index[num]; ok {
+		pg.pins++
+		pg.ref = true
+		p.stats.Hits++
+		return pg,nil
+	}
+	p.stats.Misses++
+	pg,err := p.frame()
+	if err!=nil { return nil,err }
+	pg.num = -1
+	pg.dlo,pg.dhi = 0,0
+	n := 0
+	if load {
+		n,err = p.f.ReadAt(pg.Data[:],num*PageSize)
+		if err==io.EOF { err = nil }
+		if err!=nil { return nil,err }
+	}
+	bzero(pg.Data[n:])
+	pg.num   = num
+	pg.valid = n
+	pg.pins  = 1
+	pg.ref   = true
+	p.index[num] = pg
+	return pg,nil
+}
+func (p *Pool) markDirty(pg *Page, lo, hi int) error {
+	if pg.Dirty() && (hi<pg.dlo || pg.dhi<lo) {
+		// Not contiguous: write back the old range first.
+		err := p.writeBack(pg)
+		if err!=nil { return err }
+	}
+	if !pg.Dirty() {
+		pg.dlo,pg.dhi = lo,hi
+	} else {
+		if lo<pg.dlo { pg.dlo = lo }
+		if hi>pg.dhi { pg.dhi = hi }
+	}
+	if pg.valid<hi { pg.valid = hi }
+	return nil
+}
+
+// Pins the page with the given page number, loading it, if necessary.
+func (p *Pool) Pin(num int64) (*Page,error) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	return p.pin(num,true)
+}
+func (p *Pool) Unpin(pg *Page) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	if pg.pins>0 { pg.pins-- }
+}
+
+// Marks the bytes [off,off+n) of a pinned page as modified.
+func (p *Pool) MarkDirty(pg *Page, off, n int) error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	return p.markDirty(pg,off,off+n)
+}
+
+func (p *Pool) ReadAt(b []byte, off int64) (n int,err error) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	for len(b)>0 {
+		var pg *Page
+		pg,err = p.pin(off/PageSize,true)
+		if err!=nil { return }
+		pofs := int(off%PageSize)
+		if pofs+len(b)>pg.valid && pg.valid<PageSize {
+			// The file might have grown by-passing the pool (eg. by the allocator).
+			m,_ := p.f.ReadAt(pg.Data[pg.valid:],pg.num*PageSize+int64(pg.valid))
+			pg.valid += m
+		}
+		l := 0
+		if pofs<pg.valid { l = copy(b,pg.Data[pofs:pg.valid]) }
+		pg.pins--
+		n += l
+		b = b[l:]
+		off += int64(l)
+		if len(b)>0 && pofs+l<PageSize { return n,io.EOF } // Hit the end of file.
+	}
+	return
+}
+func (p *Pool) WriteAt(b []byte, off int64) (n int,err error) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	for len(b)>0 {
+		var pg *Page
+		pofs := int(off%PageSize)
+		// A write covering the whole page doesn't need to read it first.
+		pg,err = p.pin(off/PageSize,pofs!=0 || len(b)<PageSize)
+		if err!=nil { return }
+		l := copy(pg.Data[pofs:],b)
+		err = p.markDirty(pg,pofs,pofs+l)
+		pg.pins--
+		if err!=nil { return }
+		n += l
+		b = b[l:]
+		off += int64(l)
+	}
+	return
+}
+
+// Writes back all dirty pages.
+func (p *Pool) Flush() error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	for _,pg := range p.index {
+		err := p.writeBack(pg)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Writes back and drops all pages overlapping the range [off,off+n). Pinned pages are
+reloaded instead. Must be called, if that range has been modified by-passing the pool.
+*/
+func (p *Pool) Invalidate(off, n int64) error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	if n<=0 { return nil }
+	first,last := off/PageSize,(off+n-1)/PageSize
+	if last-first>=int64(len(p.index)) {
+		// Huge range (eg. a truncated tail): visit the resident pages instead.
+		for num := range p.index {
+			if num<first || num>last { continue }
+			err := p.drop(num)
+			if err!=nil { return err }
+		}
+		return nil
+	}
+	for num := first ; num<=last ; num++ {
+		err := p.drop(num)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+// Writes back and drops all pages. Pinned pages are reloaded instead.
+func (p *Pool) InvalidateAll() error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	for num := range p.index {
+		err := p.drop(num)
+		if err!=nil { return err }
+	}
+	return nil
+}
+/*
+Drops all pages without writing them back, discarding their modifications.
+Pinned pages are reloaded instead.
+*/
+func (p *Pool) Discard() error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	var first error
+	for num,pg := range p.index {
+		pg.dlo,pg.dhi = 0,0
+		if pg.pins>0 {
+			if err := p.reload(pg) ; first==nil { first = err }
+			continue
+		}
+		delete(p.index,num)
+		pg.num = -1
+		pg.ref = false
+	}
+	return first
+}
+/*
+Writes back all dirty pages, discarding the modifications at or beyond size.
+Must be called before the file is truncated to size.
+*/
+func (p *Pool) Clip(size int64) error {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	for _,pg := range p.index {
+		if end := size-pg.num*PageSize ; end<int64(pg.dhi) {
+			if end<=int64(pg.dlo) {
+				pg.dlo,pg.dhi = 0,0
+			} else {
+				pg.dhi = int(end)
+			}
+		}
+		err := p.writeBack(pg)
+		if err!=nil { return err }
+	}
+	return nil
+}
+func (p *Pool) drop(num int64) error {
+	pg,ok := p.index[num]
+	if !ok { return nil }
+	err := p.writeBack(pg)
+	if err!=nil { return err }
+	if pg.pins>0 { return p.reload(pg) }
+	delete(p.index,num)
+	pg.num = -1
+	pg.ref = false
+	return nil
+}
+// Re-reads a clean page, that must stay resident, because it is pinned.
+func (p *Pool) reload(pg *Page) error {
+	n,err := p.f.ReadAt(pg.Data[:],pg.num*PageSize)
+	if err==io.EOF { err = nil }
+	bzero(pg.Data[n:])
+	pg.valid = n
+	return err
+}
+
+func bzero(b []byte) {
+	for i := range b { b[i] = 0 }
+}
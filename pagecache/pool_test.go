@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pagecache
+
+import "github.com/cznic/file"
+import "github.com/maxymania/gobase/dataman"
+import "bytes"
+import "io"
+import "os"
+import "testing"
+
+func tempFile(t *testing.T) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"pool")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestPoolReadWrite(t *testing.T) {
+	f := tempFile(t)
+	p := NewPool(f,4)
+	data := bytes.Repeat([]byte("0123456789"),1000) // spans three pages
+	_,err := p.WriteAt(data,100)
+	if err!=nil { t.Fatal(err) }
+	
+	got := make([]byte,len(data))
+	_,err = p.ReadAt(got,100)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(got,data) { t.Fatal("read through the pool differs from the written data") }
+	
+	err = p.Flush()
+	if err!=nil { t.Fatal(err) }
+	_,err = f.ReadAt(got,100)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(got,data) { t.Fatal("Flush() did not write the data back") }
+	
+	s := p.Stats()
+	if s.Misses!=3 || s.Hits==0 { t.Fatalf("unexpected stats %+v",s) }
+}
+
+func TestPoolEviction(t *testing.T) {
+	f := tempFile(t)
+	p := NewPool(f,2)
+	for i := int64(0) ; i<5 ; i++ {
+		_,err := p.WriteAt([]byte{byte(i+1)},i*PageSize)
+		if err!=nil { t.Fatal(err) }
+	}
+	if p.Stats().Evictions!=3 { t.Fatalf("expected 3 evictions, got %+v",p.Stats()) }
+	
+	// Evicted pages have been written back.
+	var b [1]byte
+	for i := int64(0) ; i<3 ; i++ {
+		_,err := f.ReadAt(b[:],i*PageSize)
+		if err!=nil || b[0]!=byte(i+1) { t.Fatalf("page %d: %v %v",i,b,err) }
+	}
+}
+
+func TestPoolExhausted(t *testing.T) {
+	f := tempFile(t)
+	p := NewPool(f,1)
+	_,err := p.Pin(0)
+	if err!=nil { t.Fatal(err) }
+	_,err = p.Pin(1)
+	if err!=EPoolExhausted { t.Fatalf("expected EPoolExhausted, got %v",err) }
+}
+
+func TestPoolSeesGrowth(t *testing.T) {
+	f := tempFile(t)
+	_,err := f.WriteAt([]byte("abc"),0)
+	if err!=nil { t.Fatal(err) }
+	p := NewPool(f,4)
+	b := make([]byte,3)
+	_,err = p.ReadAt(b,0)
+	if err!=nil { t.Fatal(err) }
+	
+	// The file grows by-passing the pool, the cached page only holds 3 valid bytes.
+	_,err = f.WriteAt([]byte("defg"),3)
+	if err!=nil { t.Fatal(err) }
+	b = make([]byte,7)
+	_,err = p.ReadAt(b,0)
+	if err!=nil { t.Fatal(err) }
+	if string(b)!="abcdefg" { t.Fatalf("got %q",b) }
+	
+	_,err = p.ReadAt(make([]byte,8),0)
+	if err!=io.EOF { t.Fatalf("expected io.EOF beyond the end of file, got %v",err) }
+}
+
+func TestPoolInvalidatePinned(t *testing.T) {
+	f := tempFile(t)
+	p := NewPool(f,4)
+	_,err := p.WriteAt([]byte("old"),0)
+	if err==nil { err = p.Flush() }
+	if err!=nil { t.Fatal(err) }
+	pg,err := p.Pin(0)
+	if err!=nil { t.Fatal(err) }
+	defer p.Unpin(pg)
+	
+	_,err = f.WriteAt([]byte("new"),0)
+	if err==nil { err = p.InvalidateAll() }
+	if err!=nil { t.Fatal(err) }
+	if string(pg.Data[:3])!="new" { t.Fatalf("pinned page is stale: %q",pg.Data[:3]) }
+	
+	_,err = f.WriteAt([]byte("NEW"),0)
+	if err==nil { err = p.Invalidate(0,3) }
+	if err!=nil { t.Fatal(err) }
+	b := make([]byte,3)
+	_,err = p.ReadAt(b,0)
+	if err!=nil { t.Fatal(err) }
+	if string(b)!="NEW" { t.Fatalf("got %q",b) }
+}
+
+func TestFileTruncate(t *testing.T) {
+	f := NewFile(tempFile(t),4)
+	_,err := f.WriteAt(bytes.Repeat([]byte{1},2*PageSize),0)
+	if err!=nil { t.Fatal(err) }
+	pg,err := f.Pool.Pin(1)
+	if err!=nil { t.Fatal(err) }
+	
+	err = f.Truncate(PageSize+10)
+	if err!=nil { t.Fatal(err) }
+	fi,err := f.Stat()
+	if err!=nil { t.Fatal(err) }
+	if fi.Size()!=PageSize+10 { t.Fatalf("truncated file has %d bytes",fi.Size()) }
+	if pg.valid!=10 || pg.Data[10]!=0 { t.Fatalf("pinned page is stale: %d valid bytes",pg.valid) }
+	f.Pool.Unpin(pg)
+	
+	_,err = f.ReadAt(make([]byte,11),PageSize)
+	if err!=io.EOF { t.Fatalf("expected io.EOF, got %v",err) }
+}
+
+type subscriber struct{
+	dataman.DataManager
+	f         file.File
+	listeners int
+}
+func (s *subscriber) DirectFile() file.File { return s.f }
+func (s *subscriber) RollbackFile() file.File { return s.f }
+func (s *subscriber) Subscribe(l dataman.Listener) func() {
+	s.listeners++
+	return func() { s.listeners-- }
+}
+func (s *subscriber) Close() error { return nil }
+
+func TestDataManagerClose(t *testing.T) {
+	s := &subscriber{f:tempFile(t)}
+	d := NewDataManager(s,4)
+	if s.listeners!=1 { t.Fatalf("%d listeners after NewDataManager",s.listeners) }
+	err := d.Close()
+	if err!=nil { t.Fatal(err) }
+	if s.listeners!=0 { t.Fatalf("%d listeners after Close",s.listeners) }
+}
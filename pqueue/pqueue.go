@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pqueue
+
+import "github.com/maxymania/gobase/skiplist"
+import "encoding/binary"
+import "fmt"
+import "math"
+import "sync"
+
+type Item struct{
+	Priority int64
+	Payload  int64
+}
+
+/*
+A persistent priority queue on top of an indexed skiplist. Items are ordered by priority,
+and items of equal priority by insertion order. Every operation is committed through the
+DataManager of the cache, and rolled back if it fails. The DataManager must support
+Rollback(); the cache isn't purged by the commits.
+
+The key of a node is [ Priority:8 | Seq:8 ] (the priority with the sign bit flipped, so
+that bytewise order equals numeric order). The next Seq is kept in the Content of the head.
+*/
+type Queue struct{
+	mutex sync.Mutex
+	list  *skiplist.List
+}
+
+func key(prio int64, seq uint64) []byte {
+	k := make([]byte,16)
+	binary.BigEndian.PutUint64(k,uint64(prio)^(1<<63))
+	binary.BigEndian.PutUint64(k[8:],seq)
+	return k
+}
+func item(n *skiplist.Node) Item {
+	return Item{int64(binary.BigEndian.Uint64(n.Key)^(1<<63)),n.Head.Content}
+}
+
+/*
+Commits the pending changes and rolls back the empty transaction, to find out, whether
+the DataManager supports Rollback(). Returns dataman.ENoRollback, if it doesn't.
+*/
+func checkRollback(nc *skiplist.NodeCache) error {
+	err := nc.Commit()
+	if err!=nil { return err }
+	return nc.Rollback()
+}
+
+// Rolls back the changes after the failure err. Returns err, with the Rollback() error, if any.
+func rollback(nc *skiplist.NodeCache, err error) error {
+	if rerr := nc.Rollback() ; rerr!=nil { return fmt.Errorf("%w (rollback failed: %v)",err,rerr) }
+	return err
+}
+
+/*
+Creates an empty queue and commits it, together with any pending changes.
+Fails with dataman.ENoRollback, if the DataManager isn't transactional.
+*/
+func Create(nc *skiplist.NodeCache) (*Queue,error) {
+	err := checkRollback(nc)
+	if err!=nil { return nil,err }
+	l,err := skiplist.CreateIndexedList(nc,skiplist.Bytewise)
+	if err==nil { err = nc.Commit() }
+	if err!=nil { return nil,rollback(nc,err) }
+	return &Queue{list:l},nil
+}
+/*
+Opens a queue. Any pending changes are committed.
+Fails with dataman.ENoRollback, if the DataManager isn't transactional.
+*/
+func Open(nc *skiplist.NodeCache, head int64) (*Queue,error) {
+	err := checkRollback(nc)
+	if err!=nil { return nil,err }
+	l,err := skiplist.OpenList(nc,head,skiplist.Bytewise)
+	if err!=nil { return nil,err }
+	return &Queue{list:l},nil
+}
+
+// The offset of the list head, to pass to Open().
+func (q *Queue) Head() int64 { return q.list.Head }
+
+// Commits the changes, or rolls them back, if err is set.
+func (q *Queue) done(err error) error {
+	nc := q.list.Cache
+	if err==nil { err = nc.Commit() }
+	if err!=nil { return rollback(nc,err) }
+	return nil
+}
+
+func (q *Queue) Push(prio int64, payload int64) error {
+	q.mutex.Lock(); defer q.mutex.Unlock()
+	nc := q.list.Cache
+	head,err := nc.Pin(q.list.Head)
+	if err!=nil { return err }
+	seq := uint64(head.Head.Content)
+	head.Head.Content++
+	head.Tainted = true
+	nc.Unpin(q.list.Head)
+	return q.done(q.list.Insert(key(prio,seq),payload))
+}
+
+func (q *Queue) peek() (Item,bool,error) {
+	nc := q.list.Cache
+	head,err := nc.Get(q.list.Head)
+	if err!=nil { return Item{},false,err }
+	ref := head.Head.Nexts[0]
+	if ref==0 { return Item{},false,nil }
+	first,err := nc.Get(ref)
+	if err!=nil { return Item{},false,err }
+	return item(first),true,nil
+}
+
+// Returns the item with the lowest priority without removing it.
+func (q *Queue) Peek() (Item,bool,error) {
+	q.mutex.Lock(); defer q.mutex.Unlock()
+	return q.peek()
+}
+
+// Removes up to n items, whose priority is lower than or equal to now, in one transaction.
+func (q *Queue) PopN(now int64, n int) ([]Item,error) {
+	q.mutex.Lock(); defer q.mutex.Unlock()
+	var items []Item
+	for len(items)<n {
+		it,ok,err := q.peek()
+		if err!=nil { return nil,q.done(err) }
+		if !ok || it.Priority>now { break }
+		_,ok,err = skiplist.ConsumeFirstIfLowerOrEqual(q.list.Cache,q.list.Head,key(now,math.MaxUint64))
+		if err!=nil { return nil,q.done(err) }
+		if !ok { break }
+		items = append(items,it)
+	}
+	if len(items)==0 { return nil,nil }
+	err := q.done(nil)
+	if err!=nil { return nil,err }
+	return items,nil
+}
+
+// Removes the item with the lowest priority, if its priority is lower than or equal to now.
+func (q *Queue) PopIfDue(now int64) (Item,bool,error) {
+	items,err := q.PopN(now,1)
+	if len(items)==0 { return Item{},false,err }
+	return items[0],true,nil
+}
+
+// Removes the item with the lowest priority.
+func (q *Queue) Pop() (Item,bool,error) { return q.PopIfDue(math.MaxInt64) }
+
+func (q *Queue) Len() (int64,error) {
+	q.mutex.Lock(); defer q.mutex.Unlock()
+	return q.list.Len()
+}
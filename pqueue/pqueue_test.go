@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pqueue
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/maxymania/gobase/journal"
+import "github.com/maxymania/gobase/skiplist"
+import "errors"
+import "os"
+import "strings"
+import "testing"
+
+var errAlloc = errors.New("alloc failed")
+var errRollback = errors.New("rollback failed")
+
+// A transactional DataManager, whose Alloc and Rollback fail on demand.
+type failing struct{
+	*journal.JournalDataManager
+	failAlloc, failRollback bool
+}
+func (f *failing) Alloc(size int64) (int64,error) {
+	if f.failAlloc { return 0,errAlloc }
+	return f.JournalDataManager.Alloc(size)
+}
+func (f *failing) Rollback() error {
+	if f.failRollback { return errRollback }
+	return f.JournalDataManager.Rollback()
+}
+
+func tempFile(t *testing.T) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"pqueue")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func newQueue(t *testing.T) (*failing,*Queue) {
+	j,err := journal.NewJournalDataManager(tempFile(t),tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	dm := &failing{JournalDataManager:j}
+	q,err := Create(skiplist.NodeMaster.Open(dm,false))
+	if err!=nil { t.Fatal(err) }
+	return dm,q
+}
+
+func TestQueue(t *testing.T) {
+	dm,q := newQueue(t)
+	for i,p := range []int64{5,-3,5,10,5,0} {
+		if err := q.Push(p,int64(i)) ; err!=nil { t.Fatal(err) }
+	}
+	if it,ok,err := q.Peek() ; !ok || err!=nil || it!=(Item{-3,1}) { t.Fatal("Peek",it,ok,err) }
+	if it,ok,err := q.PopIfDue(-4) ; ok || err!=nil { t.Fatal("PopIfDue before the first priority",it,ok,err) }
+	if it,ok,err := q.PopIfDue(-3) ; !ok || err!=nil || it!=(Item{-3,1}) { t.Fatal("PopIfDue",it,ok,err) }
+	
+	// Equal priorities are popped in insertion order.
+	items,err := q.PopN(5,10)
+	if err!=nil { t.Fatal(err) }
+	if len(items)!=4 || items[0]!=(Item{0,5}) || items[1]!=(Item{5,0}) || items[2]!=(Item{5,2}) || items[3]!=(Item{5,4}) { t.Fatalf("PopN got %v",items) }
+	
+	q,err = Open(skiplist.NodeMaster.Open(dm,false),q.Head())
+	if err!=nil { t.Fatal(err) }
+	if n,err := q.Len() ; n!=1 || err!=nil { t.Fatal("Len after reopening",n,err) }
+	if it,ok,err := q.Pop() ; !ok || err!=nil || it!=(Item{10,3}) { t.Fatal("Pop",it,ok,err) }
+	if it,ok,err := q.Pop() ; ok || err!=nil { t.Fatal("Pop of an empty queue",it,ok,err) }
+}
+
+func TestNotTransactional(t *testing.T) {
+	dm,err := dataman.NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	if _,err = Create(skiplist.NodeMaster.Open(dm,false)) ; err!=dataman.ENoRollback { t.Fatal("expected ENoRollback, got",err) }
+}
+
+// A failed operation is rolled back; a failed rollback is reported with the original error.
+func TestQueueFailure(t *testing.T) {
+	dm,q := newQueue(t)
+	if err := q.Push(1,1) ; err!=nil { t.Fatal(err) }
+	dm.failAlloc = true
+	if err := q.Push(2,2) ; err!=errAlloc { t.Fatal("expected the Alloc error, got",err) }
+	dm.failRollback = true
+	err := q.Push(3,3)
+	if !errors.Is(err,errAlloc) || !strings.Contains(err.Error(),errRollback.Error()) { t.Fatal("expected both errors, got",err) }
+	dm.failAlloc,dm.failRollback = false,false
+	if err = dm.Rollback() ; err!=nil { t.Fatal(err) }
+	
+	q,err = Open(skiplist.NodeMaster.Open(dm,false),q.Head())
+	if err!=nil { t.Fatal(err) }
+	items,err := q.PopN(10,10)
+	if err!=nil || len(items)!=1 || items[0]!=(Item{1,1}) { t.Fatal("PopN",items,err) }
+}
+
+// The commits of the operations don't purge the cache.
+func TestQueueCache(t *testing.T) {
+	_,q := newQueue(t)
+	for i := int64(0) ; i<10 ; i++ {
+		if err := q.Push(i,i) ; err!=nil { t.Fatal(err) }
+	}
+	misses := q.list.Cache.Stats().Misses
+	if _,_,err := q.PopIfDue(0) ; err!=nil { t.Fatal(err) }
+	if _,_,err := q.Peek() ; err!=nil { t.Fatal(err) }
+	if m := q.list.Cache.Stats().Misses ; m!=misses { t.Fatalf("%d cache misses after commits",m-misses) }
+}
@@ -24,50 +24,130 @@ SOFTWARE.
 package ring
 
 import "encoding/binary"
-import "bytes"
 import "github.com/valyala/bytebufferpool"
 import "github.com/maxymania/gobase/genericstruct"
 
 
-var NodeMaster = &genericstruct.NodeMaster{Factory:NodeConstructor}
+// The schema tag ("RG") and version of ring nodes. Nodes written before schemas were introduced are version 1.
+const (
+	SchemaTag     = 0x5247
+	SchemaVersion = 1
+)
+
+var NodeMaster = &genericstruct.NodeMasterOf[*Node]{
+	Factory:NodeConstructor,
+	Relocated:Relocated,
+	Tag:SchemaTag,
+	Version:SchemaVersion,
+	LegacyVersion:1,
+}
+
+type NodeCache = genericstruct.NodeCacheOf[*Node]
 
 type NodeHead struct{
 	Next, Prev int64
 	Tag, Content   int32
 }
 
+// Next, Prev and the lengths of Tag and Content, big endian and unpadded.
+const HeadSize = 8+8+4+4
+
+// Decodes the head from b and returns the remainder. A truncated head is decoded as zero.
+func (h *NodeHead) decode(b []byte) []byte {
+	if len(b)<HeadSize { *h = NodeHead{}; return nil }
+	h.Next    = int64(binary.BigEndian.Uint64(b[0:]))
+	h.Prev    = int64(binary.BigEndian.Uint64(b[8:]))
+	h.Tag     = int32(binary.BigEndian.Uint32(b[16:]))
+	h.Content = int32(binary.BigEndian.Uint32(b[20:]))
+	return b[HeadSize:]
+}
+func (h *NodeHead) encode(b []byte) {
+	binary.BigEndian.PutUint64(b[0:],uint64(h.Next))
+	binary.BigEndian.PutUint64(b[8:],uint64(h.Prev))
+	binary.BigEndian.PutUint32(b[16:],uint32(h.Tag))
+	binary.BigEndian.PutUint32(b[20:],uint32(h.Content))
+}
+
+// Cuts n bytes (at most len(b), negative means none) off b.
+func cut(b []byte, n int32) ([]byte,[]byte) {
+	l := int(n)
+	if l<0 { l = 0 }
+	if l>len(b) { l = len(b) }
+	return b[:l],b[l:]
+}
+
+// The stored length n as a slice length.
+func length(n int32) int {
+	if n<0 { return 0 }
+	return int(n)
+}
+
 type Node struct{
 	Head        NodeHead
 	Tag,Content []byte
 	Tainted     bool
 }
-func NodeConstructor() genericstruct.Block { return new(Node) }
+func NodeConstructor() *Node { return new(Node) }
+
+/*
+Decodes the node. Truncated Tag and Content are zero-padded to their stored lengths.
+
+Tag and Content share one allocation, when the node is loaded for the first time.
+Later loads reuse it, as long as the lengths fit.
+*/
 func (n *Node) Load(buf *bytebufferpool.ByteBuffer) {
-	src := bytes.NewReader(buf.B)
-	binary.Read(src,binary.BigEndian,&(n.Head))
-	n.Tag     = make([]byte,int(n.Head.Tag    ))
-	n.Content = make([]byte,int(n.Head.Content))
-	src.Read(n.Tag    )
-	src.Read(n.Content)
+	tag,rest := cut(n.Head.decode(buf.B),n.Head.Tag)
+	content,_ := cut(rest,n.Head.Content)
+	tl,cl := length(n.Head.Tag),length(n.Head.Content)
+	if n.Tag==nil && n.Content==nil {
+		// Never loaded before: Tag and Content share one allocation.
+		b := make([]byte,tl+cl)
+		n.Tag,n.Content = b[:0:tl],b[tl:tl]
+	}
+	n.Tag     = genericstruct.Fill(n.Tag,tag,tl)
+	n.Content = genericstruct.Fill(n.Content,content,cl)
 	n.Tainted = false
 }
 func (n *Node) Store(buf *bytebufferpool.ByteBuffer) {
 	n.Head.Tag     = int32(len(n.Tag))
 	n.Head.Content = int32(len(n.Content))
-	binary.Write(buf,binary.BigEndian,n.Head)
-	buf.Write(n.Tag)
-	buf.Write(n.Content)
+	l := len(buf.B)
+	buf.B = append(buf.B,make([]byte,HeadSize)...)
+	n.Head.encode(buf.B[l:])
+	buf.B = append(buf.B,n.Tag...)
+	buf.B = append(buf.B,n.Content...)
 	n.Tainted = false
 }
 func (n *Node) Dirty() bool { return n.Tainted }
 
+/*
+Updates the neighbours of a node, that has been moved from old to new.
+
+References to the node from outside of the ring are not updated.
+*/
+func Relocated(c *NodeCache, n *Node, old, new int64) error {
+	if n.Head.Next==0 { return nil } // Not part of a ring.
+	if n.Head.Next==old { // The only element of the ring.
+		n.Head.Next = new
+		n.Head.Prev = new
+		n.Tainted = true
+		return nil
+	}
+	p,e := c.Get(n.Head.Prev) ; if e!=nil { return e }
+	p.Head.Next = new
+	p.Tainted = true
+	x,e := c.Get(n.Head.Next) ; if e!=nil { return e }
+	x.Head.Prev = new
+	x.Tainted = true
+	return nil
+}
+
 type ListManager struct{
-	Cache *genericstruct.NodeCache
+	Cache *NodeCache
 }
 
 func (l *ListManager) Init(ring int64) error {
-	b,e := l.Cache.Get(ring) ; if e!=nil { return e }
-	n := b.(*Node)
+	n,e := l.Cache.Get(ring) ; if e!=nil { return e }
 	n.Head.Prev = ring
 	n.Head.Next = ring
 	n.Tainted = true
@@ -78,13 +158,13 @@ func (l *ListManager) Init(ring int64) error {
 func (l *ListManager) InsertAfter(ring, other int64) error {
 	// 1 <-> 3 to 1 <-> 2 <-> 3
 	i1,i2 := ring,other
-	b1,e := l.Cache.Get(i1) ; if e!=nil { return e }
-	n1 := b1.(*Node)
-	b2,e := l.Cache.Get(i2) ; if e!=nil { return e }
-	n2 := b2.(*Node)
+	n1,e := l.Cache.Pin(i1) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i1)
+	n2,e := l.Cache.Pin(i2) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i2)
 	i3 := n1.Head.Next
-	b3,e := l.Cache.Get(i3) ; if e!=nil { return e }
-	n3 := b3.(*Node)
+	n3,e := l.Cache.Pin(i3) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i3)
 	
 	// 1 -> 2 -> 3
 	n1.Head.Next = i2
@@ -103,13 +183,13 @@ func (l *ListManager) InsertAfter(ring, other int64) error {
 func (l *ListManager) InsertBefore(ring, other int64) error {
 	// 1 <-> 3 to 1 <-> 2 <-> 3
 	i3,i2 := ring,other
-	b3,e := l.Cache.Get(i3) ; if e!=nil { return e }
-	n3 := b3.(*Node)
-	b2,e := l.Cache.Get(i2) ; if e!=nil { return e }
-	n2 := b2.(*Node)
+	n3,e := l.Cache.Pin(i3) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i3)
+	n2,e := l.Cache.Pin(i2) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i2)
 	i1 := n3.Head.Prev
-	b1,e := l.Cache.Get(i1) ; if e!=nil { return e }
-	n1 := b1.(*Node)
+	n1,e := l.Cache.Pin(i1) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i1)
 	
 	// 1 -> 2 -> 3
 	n1.Head.Next = i2
@@ -129,15 +209,15 @@ func (l *ListManager) InsertBefore(ring, other int64) error {
 func (l *ListManager) Remove(ring int64) error {
 	i2 := ring
 	
-	b2,e := l.Cache.Get(i2) ; if e!=nil { return e }
-	n2 := b2.(*Node)
+	n2,e := l.Cache.Pin(i2) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i2)
 	
 	i1,i3 := n2.Head.Prev,n2.Head.Next
 	
-	b1,e := l.Cache.Get(i1) ; if e!=nil { return e }
-	n1 := b1.(*Node)
-	b3,e := l.Cache.Get(i3) ; if e!=nil { return e }
-	n3 := b3.(*Node)
+	n1,e := l.Cache.Pin(i1) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i1)
+	n3,e := l.Cache.Pin(i3) ; if e!=nil { return e }
+	defer l.Cache.Unpin(i3)
 	
 	n1.Head.Next = i3
 	n3.Head.Prev = i1
@@ -151,22 +231,75 @@ func (l *ListManager) Remove(ring int64) error {
 	return nil
 }
 func (l *ListManager) Next(it int64) (ref int64,dat *Node,err error) {
-	var b genericstruct.Block
-	b,err = l.Cache.Get(it)
+	dat,err = l.Cache.Get(it)
 	if err!=nil { return }
-	ref = b.(*Node).Head.Next
-	b,err = l.Cache.Get(ref)
-	if err!=nil { return }
-	dat = b.(*Node)
+	ref = dat.Head.Next
+	dat,err = l.Cache.Get(ref)
 	return
 }
 func (l *ListManager) Prev(it int64) (ref int64,dat *Node,err error) {
-	var b genericstruct.Block
-	b,err = l.Cache.Get(it)
-	if err!=nil { return }
-	ref = b.(*Node).Head.Prev
-	b,err = l.Cache.Get(ref)
+	dat,err = l.Cache.Get(it)
 	if err!=nil { return }
-	dat = b.(*Node)
+	ref = dat.Head.Prev
+	dat,err = l.Cache.Get(ref)
 	return
 }
+
+/*
+Iterates over the elements of a ring (excluding the ring node itself), reading the following
+nodes ahead in the background.
+
+The ring must not be modified during the iteration.
+*/
+type Iterator struct{
+	ahead   genericstruct.ReadAhead[*Node]
+	ring    int64
+	ref     int64
+	node    *Node
+	reverse bool
+	err     error
+}
+func (l *ListManager) Iterate(ring int64, reverse bool) *Iterator {
+	it := &Iterator{ring:ring,reverse:reverse}
+	it.ahead.Cache = l.Cache
+	it.ahead.Next = it.succ
+	return it
+}
+// Sets the number of nodes to read ahead. Negative values disable read-ahead.
+func (it *Iterator) SetReadAhead(n int) { it.ahead.N = n }
+func (it *Iterator) succ(n *Node) int64 {
+	next := n.Head.Next
+	if it.reverse { next = n.Head.Prev }
+	if next==it.ring { return 0 }
+	return next
+}
+
+/*
+Advances to the next element. Returns false at the end of the ring, or on error.
+The read-ahead is stopped, once it returns false.
+*/
+func (it *Iterator) Next() bool {
+	if it.next() { return true }
+	it.ahead.Stop()
+	return false
+}
+func (it *Iterator) next() bool {
+	if it.err!=nil || it.ref==it.ring { return false }
+	cur := it.ref
+	if cur==0 { cur = it.ring }
+	n,err := it.ahead.Cache.Get(cur)
+	if err!=nil { it.err = err; return false }
+	next := it.succ(n)
+	if next==0 { it.ref,it.node = it.ring,nil; return false }
+	it.node,it.err = it.ahead.Cache.Get(next)
+	if it.err!=nil { return false }
+	it.ref = next
+	it.ahead.From(it.succ(it.node))
+	return true
+}
+func (it *Iterator) Ref() int64 { return it.ref }
+func (it *Iterator) Node() *Node { return it.node }
+func (it *Iterator) Err() error { return it.err }
+
+// Stops the read-ahead.
+func (it *Iterator) Close() { it.ahead.Stop() }
@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ring
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/maxymania/gobase/genericstruct"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "encoding/binary"
+import "os"
+import "reflect"
+import "testing"
+
+// The reflection-based codec, that Node replaced.
+func refLoad(n *Node, buf *bytebufferpool.ByteBuffer) {
+	src := bytes.NewReader(buf.B)
+	binary.Read(src,binary.BigEndian,&(n.Head))
+	n.Tag     = make([]byte,int(n.Head.Tag    ))
+	n.Content = make([]byte,int(n.Head.Content))
+	src.Read(n.Tag    )
+	src.Read(n.Content)
+}
+func refStore(n *Node, buf *bytebufferpool.ByteBuffer) {
+	n.Head.Tag     = int32(len(n.Tag))
+	n.Head.Content = int32(len(n.Content))
+	binary.Write(buf,binary.BigEndian,n.Head)
+	buf.Write(n.Tag)
+	buf.Write(n.Content)
+}
+
+func testNode() *Node {
+	return &Node{Head:NodeHead{Next:4096,Prev:-8192},Tag:[]byte("tag"),Content:[]byte("some content")}
+}
+
+func TestNodeRoundTrip(t *testing.T) {
+	n := testNode()
+	a,b := new(bytebufferpool.ByteBuffer),new(bytebufferpool.ByteBuffer)
+	n.Store(a)
+	refStore(n,b)
+	if !bytes.Equal(a.B,b.B) { t.Fatal("the encoding differs from binary.Write") }
+	for _,load := range []func(*Node,*bytebufferpool.ByteBuffer){(*Node).Load,refLoad} {
+		m := NodeConstructor()
+		load(m,a)
+		if !reflect.DeepEqual(m,n) { t.Fatalf("got %+v, want %+v",m,n) }
+	}
+}
+
+// Truncated Tag and Content are zero-padded, like binary.Read left them.
+func TestNodeTruncated(t *testing.T) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	buf.B = buf.B[:HeadSize+5]
+	n,m := NodeConstructor(),NodeConstructor()
+	n.Load(buf)
+	refLoad(m,buf)
+	if !reflect.DeepEqual(n,m) { t.Fatalf("got %+v, want %+v",n,m) }
+}
+
+func TestNodeReuse(t *testing.T) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	n := NodeConstructor()
+	if allocs := testing.AllocsPerRun(100,func() { *n = Node{}; n.Load(buf) }) ; allocs!=1 { t.Fatalf("%v allocations per fresh load",allocs) }
+	if allocs := testing.AllocsPerRun(100,func() { n.Load(buf) }) ; allocs!=0 { t.Fatalf("%v allocations per reload",allocs) }
+}
+
+func newCache(t *testing.T) *NodeCache {
+	f,err := os.CreateTemp(t.TempDir(),"ring")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	dm,err := dataman.NewSimpleDataManager(f)
+	if err!=nil { t.Fatal(err) }
+	return NodeMaster.Open(dm,false)
+}
+
+// Creates a ring with n elements, whose Content is their index, and returns the ring node and the elements.
+func newRing(t *testing.T, n int) (*ListManager,int64,[]int64) {
+	l := &ListManager{Cache:newCache(t)}
+	ring,err := l.Cache.Set(new(Node))
+	if err==nil { err = l.Init(ring) }
+	if err!=nil { t.Fatal(err) }
+	elems := make([]int64,n)
+	for i := range elems {
+		elems[i],err = l.Cache.Set(&Node{Content:[]byte{byte(i)}})
+		if err==nil { err = l.InsertBefore(ring,elems[i]) }
+		if err!=nil { t.Fatal(err) }
+	}
+	if err = l.Cache.Flush() ; err!=nil { t.Fatal(err) }
+	return l,ring,elems
+}
+
+// Checks, that the ring links ring and elems in this order, in both directions.
+func checkRing(t *testing.T, l *ListManager, ring int64, elems []int64) {
+	t.Helper()
+	all := append([]int64{ring},elems...)
+	for i,off := range all {
+		n,err := l.Cache.Get(off)
+		if err!=nil { t.Fatal(err) }
+		next,prev := all[(i+1)%len(all)],all[(i+len(all)-1)%len(all)]
+		if n.Head.Next!=next || n.Head.Prev!=prev { t.Fatalf("node %d links %d <-> %d, want %d <-> %d",off,n.Head.Prev,n.Head.Next,prev,next) }
+	}
+}
+
+// An element, that outgrows its allocation, is moved and its neighbours are relinked.
+func TestRelocated(t *testing.T) {
+	l,ring,elems := newRing(t,3)
+	for _,i := range []int{0,2,1} {
+		n,err := l.Cache.Get(elems[i])
+		if err!=nil { t.Fatal(err) }
+		n.Content = bytes.Repeat([]byte{byte(i)},1000)
+		n.Tainted = true
+		err = l.Cache.WriteBack()
+		ef,ok := err.(genericstruct.EFlush)
+		if !ok || len(ef.TooLarge())!=1 || ef.TooLarge()[0]!=elems[i] { t.Fatalf("expected %d to be too large, got %v",elems[i],err) }
+		noff,err := l.Cache.Relocate(elems[i])
+		if err!=nil { t.Fatal(err) }
+		if noff==elems[i] { t.Fatal("the node has not been moved") }
+		elems[i] = noff
+		checkRing(t,l,ring,elems)
+	}
+	if err := l.Cache.Flush() ; err!=nil { t.Fatal(err) }
+	checkRing(t,l,ring,elems)
+	n,err := l.Cache.Get(elems[1])
+	if err!=nil { t.Fatal(err) }
+	if len(n.Content)!=1000 { t.Fatalf("the moved node has %d bytes of content",len(n.Content)) }
+}
+
+// The only element of a ring links itself.
+func TestRelocatedSingle(t *testing.T) {
+	c := newCache(t)
+	l := &ListManager{Cache:c}
+	off,err := c.Set(new(Node))
+	if err==nil { err = l.Init(off) }
+	if err==nil { err = c.WriteBack() }
+	if err!=nil { t.Fatal(err) }
+	n,err := c.Get(off)
+	if err!=nil { t.Fatal(err) }
+	n.Tag = make([]byte,100)
+	n.Tainted = true
+	c.WriteBack() // Fails, the node must be moved.
+	noff,err := c.Relocate(off)
+	if err!=nil { t.Fatal(err) }
+	checkRing(t,l,noff,nil)
+}
+
+// Walks the ring in both directions, with and without read-ahead, and stops at the ring node.
+func TestIterator(t *testing.T) {
+	l,ring,_ := newRing(t,10)
+	for _,reverse := range []bool{false,true} {
+		for _,ahead := range []int{-1,0,3} {
+			if err := l.Cache.Flush() ; err!=nil { t.Fatal(err) }
+			it := l.Iterate(ring,reverse)
+			it.SetReadAhead(ahead)
+			var got []int
+			for it.Next() {
+				got = append(got,int(it.Node().Content[0]))
+				if it.Ref()==ring { t.Fatal("the ring node has been visited") }
+			}
+			if it.Err()!=nil { t.Fatal(it.Err()) }
+			if it.Next() || it.Ref()!=ring || it.Node()!=nil { t.Fatal("the iterator did not stop at the ring node") }
+			it.Close()
+			if len(got)!=10 { t.Fatalf("reverse %v, read-ahead %d: visited %v",reverse,ahead,got) }
+			for j,v := range got {
+				want := j
+				if reverse { want = 9-j }
+				if v!=want { t.Fatalf("reverse %v, read-ahead %d: visited %v",reverse,ahead,got) }
+			}
+		}
+	}
+}
+
+func TestIteratorEmpty(t *testing.T) {
+	l,ring,_ := newRing(t,0)
+	it := l.Iterate(ring,false)
+	defer it.Close()
+	if it.Next() || it.Err()!=nil { t.Fatalf("an empty ring has elements (error %v)",it.Err()) }
+}
+
+func BenchmarkNodeLoad(b *testing.B) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { NodeConstructor().Load(buf) }
+}
+func BenchmarkNodeLoadReflect(b *testing.B) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { refLoad(NodeConstructor(),buf) }
+}
+func BenchmarkNodeStore(b *testing.B) {
+	buf,n := new(bytebufferpool.ByteBuffer),testNode()
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { buf.Reset(); n.Store(buf) }
+}
+func BenchmarkNodeStoreReflect(b *testing.B) {
+	buf,n := new(bytebufferpool.ByteBuffer),testNode()
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { buf.Reset(); refStore(n,buf) }
+}
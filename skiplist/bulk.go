@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "errors"
+
+var EUnsorted = errors.New("EUnsorted")
+
+/*
+Moves the k.Ptrs forward to the last nodes before key. They must be before key already,
+as they are after a search for a lower key. Returns whether key exists, and whether the
+k.Ptrs are the last nodes of the list.
+*/
+func (k *KeySearcher) advance(key []byte) (found, last bool, err error) {
+	for i := Steps-1 ; 0<=i ; i-- {
+		node,err := k.Cache.Get(k.Ptrs[i])
+		if err!=nil { return false,false,err }
+		for node.Head.Nexts[i]!=0 {
+			next,err := k.Cache.Get(node.Head.Nexts[i])
+			if err!=nil { return false,false,err }
+			c := k.compare(next.Key,key)
+			if c>=0 {
+				found = c==0
+				break
+			}
+			k.Ranks[i] += node.span(i)
+			k.Ptrs[i],node = node.Head.Nexts[i],next
+		}
+		if i==0 { last = node.Head.Nexts[0]==0 }
+	}
+	return
+}
+
+/*
+Inserts sorted key/value pairs into the skiplist in a single pass. next returns the pairs,
+ok=false ends the input. The keys must be strictly ascending, otherwise EUnsorted is returned,
+and must not exist in the list, otherwise EExists is returned. The pairs loaded until then
+remain in the list. Returns the number of pairs loaded.
+
+The position of the previous key is the starting point for the next one, so a key costs
+O(1) amortized plus the nodes of the list, that are passed over. Keys after the last one of
+the list are appended without any search. The new nodes are allocated in input order; the
+cache must be flushed afterwards.
+*/
+func BulkLoad(nc *NodeCache,off int64,next func() (key []byte, value int64, ok bool)) (int64,error) {
+	ks := KeySearcher{Cache:nc}
+	head,err := nc.Get(off)
+	if err!=nil { return 0,err }
+	ks.cmp,err = head.comparator()
+	if err!=nil { return 0,err }
+	ks.indexed = head.Spans!=nil
+	for i := range ks.Ptrs { ks.Ptrs[i] = off }
+	last := head.Head.Nexts[0]==0
+	
+	var prev []byte
+	n := int64(0)
+	for {
+		key,value,ok := next()
+		if !ok { break }
+		if n>0 && ks.compare(prev,key)>=0 { return n,EUnsorted }
+		prev = append(prev[:0],key...)
+		if !last {
+			var found bool
+			found,last,err = ks.advance(key)
+			if err!=nil { return n,err }
+			if found { return n,EExists }
+		}
+		
+		level := randomLevel()
+		node := &Node{Key:append([]byte(nil),key...),Head:NodeHead{Content:value}}
+		if ks.indexed { node.Spans = make([]uint32,level+1) }
+		noff,err := nc.Add(node)
+		if err!=nil { return n,err }
+		err = ks.link(noff,level)
+		if err!=nil { return n,err }
+		
+		// The new node precedes the next key.
+		pos := ks.Ranks[0]+1
+		for i := 0 ; i<=level ; i++ { ks.Ptrs[i],ks.Ranks[i] = noff,pos }
+		n++
+	}
+	return n,nil
+}
+
+func (l *List) BulkLoad(next func() (key []byte, value int64, ok bool)) (int64,error) {
+	return BulkLoad(l.Cache,l.Head,next)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "testing"
+
+// Returns the keys from, from+step, ... (n keys) as BulkLoad input.
+func sequence(from, step int64, n int) func() ([]byte,int64,bool) {
+	return func() ([]byte,int64,bool) {
+		if n==0 { return nil,0,false }
+		n--
+		v := from
+		from += step
+		return Int64Key(v),v,true
+	}
+}
+func slice(keys ...int64) func() ([]byte,int64,bool) {
+	return func() ([]byte,int64,bool) {
+		if len(keys)==0 { return nil,0,false }
+		v := keys[0]
+		keys = keys[1:]
+		return Int64Key(v),v,true
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	l,err := CreateIndexedList(newCache(t),Int64)
+	if err!=nil { t.Fatal(err) }
+	if n,err := l.BulkLoad(sequence(0,2,500)) ; n!=500 || err!=nil { t.Fatal("BulkLoad",n,err) }
+	// Interleave odd keys, including some before and after all existing ones.
+	if n,err := l.BulkLoad(sequence(-11,2,510)) ; n!=510 || err!=nil { t.Fatal("interleaved BulkLoad",n,err) }
+	var keys []int64
+	for k := int64(-11) ; k<=1007 ; k++ {
+		if k%2!=0 || k<1000 && k>=0 { keys = append(keys,k) }
+	}
+	checkOrder(t,l,keys)
+	if got := collect(t,NewIterator(l.Cache,l.Head)) ; !equal(got,keys) { t.Fatalf("iteration got %d keys",len(got)) }
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	l := intList(t,newCache(t),5) // 0..4
+	if n,err := l.BulkLoad(slice(10,12,11,13)) ; n!=2 || err!=EUnsorted { t.Fatal("unsorted input",n,err) }
+	if n,err := l.BulkLoad(slice(20,20)) ; n!=1 || err!=EUnsorted { t.Fatal("duplicate input",n,err) }
+	if n,err := l.BulkLoad(slice(-1,3,30)) ; n!=1 || err!=EExists { t.Fatal("existing key",n,err) }
+	if got := collect(t,NewIterator(l.Cache,l.Head)) ; !equal(got,[]int64{-1,0,1,2,3,4,10,12,20}) { t.Fatalf("got %v",got) }
+}
+
+// Builds a list of 20000 sorted keys.
+func BenchmarkBulkLoad(b *testing.B) {
+	for i := 0 ; i<b.N ; i++ {
+		l,err := CreateList(newCache(b),Int64)
+		if err!=nil { b.Fatal(err) }
+		if _,err = l.BulkLoad(sequence(0,1,20000)) ; err!=nil { b.Fatal(err) }
+		if err = l.Cache.Flush() ; err!=nil { b.Fatal(err) }
+	}
+}
+func BenchmarkInsertSorted(b *testing.B) {
+	for i := 0 ; i<b.N ; i++ {
+		l,err := CreateList(newCache(b),Int64)
+		if err!=nil { b.Fatal(err) }
+		for k := int64(0) ; k<20000 ; k++ {
+			if err = l.Insert(Int64Key(k),k) ; err!=nil { b.Fatal(err) }
+		}
+		if err = l.Cache.Flush() ; err!=nil { b.Fatal(err) }
+	}
+}
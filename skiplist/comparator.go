@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "sync"
+import "unicode"
+import "unicode/utf8"
+
+/*
+Orders the keys of a skiplist: negative if a<b, zero if a==b, positive if a>b.
+
+The comparator of a list is named in its head node (see Node.Comparator), an empty name
+means Bytewise. Heads written before version 4 have no name, so those lists are Bytewise.
+*/
+type Comparator func(a, b []byte) int
+
+const (
+	Bytewise = "bytewise"
+	Reverse  = "reverse"
+	NoCase   = "utf8-nocase"
+	Int64    = "int64"
+)
+
+type EComparator struct{
+	Name string
+}
+func (e *EComparator) Error() string { return fmt.Sprintf("Unknown comparator %q",e.Name) }
+
+type EComparatorMismatch struct{
+	Want,Have string
+}
+func (e *EComparatorMismatch) Error() string {
+	return fmt.Sprintf("Comparator mismatch: want %q, list has %q",e.Want,e.Have)
+}
+
+var comparators = struct{
+	sync.RWMutex
+	m map[string]Comparator
+}{m:map[string]Comparator{
+	Bytewise: bytes.Compare,
+	Reverse : func(a, b []byte) int { return bytes.Compare(b,a) },
+	NoCase  : compareNoCase,
+	Int64   : compareInt64,
+}}
+
+/*
+Registers a comparator. The ordering of a name must never change once lists use it.
+The name must not be longer than 255 bytes.
+*/
+func RegisterComparator(name string, c Comparator) {
+	if len(name)>255 { panic("comparator name too long") }
+	comparators.Lock(); defer comparators.Unlock()
+	comparators.m[name] = c
+}
+func LookupComparator(name string) Comparator {
+	if name=="" { return bytes.Compare }
+	comparators.RLock(); defer comparators.RUnlock()
+	return comparators.m[name]
+}
+
+/*
+Case-insensitive order of UTF-8 strings. Keys, that differ in case only, are equal.
+Bytes, that aren't valid UTF-8, are compared bytewise and sort after all runes, so
+that distinct invalid keys don't compare equal.
+*/
+func compareNoCase(a, b []byte) int {
+	for len(a)>0 && len(b)>0 {
+		ra,na := foldRune(a)
+		rb,nb := foldRune(b)
+		if ra!=rb {
+			if ra<rb { return -1 }
+			return 1
+		}
+		a,b = a[na:],b[nb:]
+	}
+	return len(a)-len(b)
+}
+// Decodes and case-folds the first rune of b. An invalid byte is mapped above utf8.MaxRune.
+func foldRune(b []byte) (rune,int) {
+	r,n := utf8.DecodeRune(b)
+	if r==utf8.RuneError && n==1 { return utf8.MaxRune+1+rune(b[0]),1 }
+	return unicode.ToLower(unicode.ToUpper(r)),n
+}
+
+// Signed order of 8 byte big endian keys (see Int64Key). Keys of other lengths are sorted by length first.
+func compareInt64(a, b []byte) int {
+	if len(a)!=8 || len(b)!=8 {
+		if len(a)!=len(b) { return len(a)-len(b) }
+		return bytes.Compare(a,b)
+	}
+	x,y := int64(binary.BigEndian.Uint64(a)),int64(binary.BigEndian.Uint64(b))
+	switch {
+	case x<y: return -1
+	case x>y: return 1
+	}
+	return 0
+}
+
+// Encodes i as key for the Int64 comparator.
+func Int64Key(i int64) []byte {
+	k := make([]byte,8)
+	binary.BigEndian.PutUint64(k,uint64(i))
+	return k
+}
+
+// Returns the comparator named by the head node.
+func (n *Node) comparator() (Comparator,error) {
+	c := LookupComparator(n.Comparator)
+	if c==nil { return nil,&EComparator{n.Comparator} }
+	return c,nil
+}
+func comparatorOf(nc *NodeCache,head int64) (Comparator,error) {
+	node,err := nc.Get(head)
+	if err!=nil { return nil,err }
+	return node.comparator()
+}
+
+/*
+A skiplist, opened with its comparator.
+*/
+type List struct{
+	Cache *NodeCache
+	Head  int64
+}
+
+// Creates an empty skiplist, that is ordered by the named comparator.
+func CreateList(nc *NodeCache, cmp string) (*List,error) {
+	return createList(nc,&Node{},cmp)
+}
+func createList(nc *NodeCache, head *Node, cmp string) (*List,error) {
+	if LookupComparator(cmp)==nil { return nil,&EComparator{cmp} }
+	if cmp!=Bytewise { head.Comparator = cmp }
+	off,err := nc.Set(head)
+	if err!=nil { return nil,err }
+	return &List{nc,off},nil
+}
+
+// Opens an existing skiplist. It fails, if the list is ordered by a different comparator.
+func OpenList(nc *NodeCache, head int64, cmp string) (*List,error) {
+	node,err := nc.Get(head)
+	if err!=nil { return nil,err }
+	have := node.Comparator
+	if have=="" { have = Bytewise }
+	if cmp=="" { cmp = Bytewise }
+	if have!=cmp { return nil,&EComparatorMismatch{cmp,have} }
+	if _,err = node.comparator() ; err!=nil { return nil,err }
+	return &List{nc,head},nil
+}
+
+func (l *List) Lookup(key []byte) (int64,bool,error) { return Lookup(l.Cache,l.Head,key) }
+func (l *List) Insert(key []byte, value int64) error { return InsertionAlgorithmV1(l.Cache,l.Head,key,value) }
+func (l *List) Delete(key []byte) (bool,error) { return Delete(l.Cache,l.Head,key) }
+func (l *List) Range(start, end []byte) *Iterator { return NewRangeIterator(l.Cache,l.Head,start,end) }
+func (l *List) KV() *KV { return &KV{Cache:l.Cache,Head:l.Head} }
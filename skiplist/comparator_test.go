@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "github.com/valyala/bytebufferpool"
+import "testing"
+
+func sign(i int) int {
+	switch {
+	case i<0: return -1
+	case i>0: return 1
+	}
+	return 0
+}
+
+func TestCompareNoCase(t *testing.T) {
+	cases := []struct{
+		a,b string
+		c   int
+	}{
+		{"abc","ABC",0},
+		{"straße","STRASSE",1}, // ß is not expanded
+		{"Äpfel","äpfel",0},
+		{"a","ab",-1},
+		{"\xff","\xfe",1},
+		{"a\xff","A\xfe",1},
+		{"\xff","\xff",0},
+		{"\xc3","\xc3\x84",1}, // a truncated sequence sorts after the rune Ä
+		{"z","\x80",-1},
+	}
+	for _,c := range cases {
+		if got := sign(compareNoCase([]byte(c.a),[]byte(c.b))) ; got!=c.c { t.Errorf("compare(%q,%q) = %d, expected %d",c.a,c.b,got,c.c) }
+		if got := sign(compareNoCase([]byte(c.b),[]byte(c.a))) ; got!=-c.c { t.Errorf("compare(%q,%q) = %d, expected %d",c.b,c.a,got,-c.c) }
+	}
+	
+	// The order must be transitive, even across case variants and invalid bytes.
+	keys := []string{"K","k","\u212a","\xe2\x84","\xe2\x50","\xff","","L"}
+	for _,a := range keys {
+		for _,b := range keys {
+			for _,c := range keys {
+				ab,bc,ac := compareNoCase([]byte(a),[]byte(b)),compareNoCase([]byte(b),[]byte(c)),compareNoCase([]byte(a),[]byte(c))
+				if ab<=0 && bc<=0 && ac>0 { t.Errorf("%q<=%q<=%q, but %q>%q",a,b,c,a,c) }
+			}
+		}
+	}
+}
+
+func TestComparators(t *testing.T) {
+	nc := newCache(t)
+	for _,c := range []struct{
+		name string
+		keys []string // in order
+	}{
+		{Bytewise,[]string{"A","B","a"}},
+		{Reverse,[]string{"b","a","B"}},
+		{NoCase,[]string{"a","B","c"}},
+		{Int64,[]string{string(Int64Key(-2)),string(Int64Key(1)),string(Int64Key(300))}},
+	} {
+		l,err := CreateList(nc,c.name)
+		if err!=nil { t.Fatal(err) }
+		for _,i := range []int{2,0,1} {
+			if err = l.Insert([]byte(c.keys[i]),int64(i)) ; err!=nil { t.Fatal(err) }
+		}
+		if got := collect(t,NewIterator(nc,l.Head)) ; !equal(got,[]int64{0,1,2}) { t.Errorf("%s: got %v",c.name,got) }
+		if _,err = OpenList(nc,l.Head,c.name) ; err!=nil { t.Errorf("%s: %v",c.name,err) }
+		if _,err = OpenList(nc,l.Head,"other") ; err==nil { t.Errorf("%s: opened with the wrong comparator",c.name) }
+	}
+	if _,err := CreateList(nc,"unknown") ; err==nil { t.Fatal("created a list with an unknown comparator") }
+	
+	l,err := CreateList(nc,NoCase)
+	if err!=nil { t.Fatal(err) }
+	if err = l.Insert([]byte("Key"),1) ; err!=nil { t.Fatal(err) }
+	if err = l.Insert([]byte("KEY"),2) ; err!=EExists { t.Fatal("expected EExists for a case variant, got",err) }
+	if v,ok,err := l.Lookup([]byte("kEy")) ; v!=1 || !ok || err!=nil { t.Fatal("Lookup of a case variant",v,ok,err) }
+}
+
+// The comparator is stored in its own section of the head; heads of older lists name it by their key.
+func TestComparatorHead(t *testing.T) {
+	nc := newCache(t)
+	l,err := CreateList(nc,Int64)
+	if err!=nil { t.Fatal(err) }
+	if err = nc.Flush() ; err!=nil { t.Fatal(err) }
+	head,err := nc.Get(l.Head)
+	if err!=nil { t.Fatal(err) }
+	if len(head.Key)!=0 || head.Comparator!=Int64 { t.Fatalf("head has key %q and comparator %q",head.Key,head.Comparator) }
+	if head.StoreLegacy(new(bytebufferpool.ByteBuffer)) { t.Fatal("a head with comparator is stored without schema prefix") }
+	
+	// A head without comparator section is bytewise, whatever its key is.
+	old,err := nc.Set(&Node{Key:[]byte(Int64)})
+	if err!=nil { t.Fatal(err) }
+	if _,err = OpenList(nc,old,Int64) ; err==nil { t.Fatal("opened an old list as int64") }
+	ol,err := OpenList(nc,old,Bytewise)
+	if err!=nil { t.Fatal(err) }
+	for i,k := range []string{"b","a","c"} {
+		if err = ol.Insert([]byte(k),int64(i)) ; err!=nil { t.Fatal(err) }
+	}
+	if got := collect(t,NewIterator(nc,old)) ; !equal(got,[]int64{1,0,2}) { t.Fatalf("got %v",got) }
+	if v,ok,err := ol.Lookup([]byte("c")) ; v!=2 || !ok || err!=nil { t.Fatal("Lookup",v,ok,err) }
+}
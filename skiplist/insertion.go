@@ -24,7 +24,6 @@ SOFTWARE.
 package skiplist
 
 import "math/rand"
-import "github.com/maxymania/gobase/genericstruct"
 
 func randomLevel() int {
 	levelval := rand.Int31()
@@ -43,7 +42,7 @@ func randomLevel() int {
 	return Steps-1
 }
 
-func InsertionAlgorithmV1(nc *genericstruct.NodeCache,off int64,key []byte, value int64) error {
+func InsertionAlgorithmV1(nc *NodeCache,off int64,key []byte, value int64) error {
 	ks := KeySearcher{Cache:nc}
 	err := ks.Steps(off,key)
 	if err!=nil { return err }
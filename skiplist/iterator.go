@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "github.com/maxymania/gobase/genericstruct"
+
+func nextNode(n *Node) int64 { return n.Head.Nexts[0] }
+
+/*
+Iterates over the elements of a skiplist in ascending order, reading the following nodes
+ahead in the background. The iteration can be limited to the keys in [start,end).
+A reverse Iterator walks in descending order instead; every step is a search from
+the head, and there is no read-ahead.
+
+The skiplist must not be modified during the iteration.
+
+	it := skiplist.NewRangeIterator(nc,head,[]byte("a"),[]byte("b"))
+	for ok := it.SeekFirst() ; ok ; ok = it.Next() {
+		fmt.Println(it.Key(),it.Value())
+	}
+	it.Close()
+	if it.Err()!=nil { ... }
+*/
+type Iterator struct{
+	ahead genericstruct.ReadAhead[*Node]
+	head  int64
+	start []byte
+	end   []byte
+	reverse bool
+	incl  bool // end is inclusive
+	filter func(*Node) bool // if set, only nodes, it accepts, are visited
+	cmp   Comparator
+	ref   int64
+	node  *Node
+	err   error
+}
+func NewIterator(nc *NodeCache, head int64) *Iterator {
+	return NewRangeIterator(nc,head,nil,nil)
+}
+// An Iterator over the keys in [start,end). A nil start or end means unbounded.
+func NewRangeIterator(nc *NodeCache, head int64, start, end []byte) *Iterator {
+	it := &Iterator{head:head,start:start,end:end}
+	it.ahead.Cache = nc
+	it.ahead.Next = nextNode
+	return it
+}
+// A descending Iterator over the keys in [start,end). A nil start or end means unbounded.
+func NewReverseIterator(nc *NodeCache, head int64, start, end []byte) *Iterator {
+	it := NewRangeIterator(nc,head,start,end)
+	it.reverse = true
+	return it
+}
+// Sets the number of nodes to read ahead. Negative values disable read-ahead.
+func (it *Iterator) SetReadAhead(n int) { it.ahead.N = n }
+
+/*
+Positions the iterator at the node ref (or the first one after it, that the filter accepts),
+or invalidates it, if there is none in range. The read-ahead is stopped, once the iterator
+is invalid.
+*/
+func (it *Iterator) at(ref int64) bool {
+	for it.move(ref) {
+		if it.filter==nil || it.filter(it.node) { return true }
+		ref = it.following()
+	}
+	it.ahead.Stop()
+	return false
+}
+func (it *Iterator) move(ref int64) bool {
+	it.ref,it.node = 0,nil
+	if ref==0 || it.err!=nil { return false }
+	node,err := it.ahead.Cache.Get(ref)
+	if err!=nil { it.err = err; return false }
+	if it.reverse {
+		if it.start!=nil && it.cmp(node.Key,it.start)<0 { return false }
+	} else if it.end!=nil {
+		c := it.cmp(node.Key,it.end)
+		if c>0 || (c==0 && !it.incl) { return false }
+	}
+	it.ref,it.node = ref,node
+	if !it.reverse { it.ahead.From(node.Head.Nexts[0]) }
+	return true
+}
+
+// Invalidates the iterator and looks up the comparator of the list.
+func (it *Iterator) reset() bool {
+	it.ref,it.node,it.err = 0,nil,nil
+	if it.cmp==nil { it.cmp,it.err = comparatorOf(it.ahead.Cache,it.head) }
+	return it.err==nil
+}
+
+// Moves to the first element (the last one, if reversed). Returns false, if the range is empty.
+func (it *Iterator) SeekFirst() bool {
+	if it.reverse { return it.seekLast() }
+	if it.start!=nil { return it.Seek(it.start) }
+	if !it.reset() { return false }
+	head,err := it.ahead.Cache.Get(it.head)
+	if err!=nil { it.err = err; return false }
+	return it.at(head.Head.Nexts[0])
+}
+func (it *Iterator) seekLast() bool {
+	if !it.reset() { return false }
+	ks := KeySearcher{Cache:it.ahead.Cache}
+	var ref int64
+	if it.end!=nil && it.incl {
+		ref,it.err = ks.floor(it.head,it.end)
+	} else if it.end!=nil {
+		ref,it.err = ks.lower(it.head,it.end)
+	} else {
+		ref,it.err = ks.last(it.head)
+	}
+	return it.at(ref)
+}
+/*
+Moves to the first element, whose key is greater than or equal to key.
+If reversed, it moves to the last element, whose key is lower than or equal to key.
+*/
+func (it *Iterator) Seek(key []byte) bool {
+	if !it.reset() { return false }
+	if it.reverse {
+		if it.end!=nil {
+			c := it.cmp(key,it.end)
+			if c>0 || (c==0 && !it.incl) { return it.seekLast() }
+		}
+		ks := KeySearcher{Cache:it.ahead.Cache}
+		var ref int64
+		ref,it.err = ks.floor(it.head,key)
+		return it.at(ref)
+	}
+	if it.start!=nil && it.cmp(key,it.start)<0 { key = it.start }
+	ks := KeySearcher{Cache:it.ahead.Cache}
+	err := ks.Steps(it.head,key)
+	if err!=nil { it.err = err; return false }
+	prev,err := it.ahead.Cache.Get(ks.Ptrs[0])
+	if err!=nil { it.err = err; return false }
+	return it.at(prev.Head.Nexts[0])
+}
+// Returns the node following the current one in iteration order.
+func (it *Iterator) following() int64 {
+	if !it.reverse { return it.node.Head.Nexts[0] }
+	ks := KeySearcher{Cache:it.ahead.Cache}
+	var ref int64
+	ref,it.err = ks.lowerPair(it.head,it.node.Key,it.node.Head.Content)
+	return ref
+}
+// Moves to the next element. Returns false at the end of the list.
+func (it *Iterator) Next() bool {
+	if it.node==nil { return false }
+	return it.at(it.following())
+}
+func (it *Iterator) Valid() bool { return it.node!=nil }
+func (it *Iterator) Key() []byte { return it.node.Key }
+func (it *Iterator) Value() int64 { return it.node.Head.Content }
+func (it *Iterator) Ref() int64 { return it.ref }
+func (it *Iterator) Node() *Node { return it.node }
+func (it *Iterator) Err() error { return it.err }
+
+// Stops the read-ahead.
+func (it *Iterator) Close() { it.ahead.Stop() }
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/cznic/file"
+import "testing"
+import "time"
+
+// Builds a list of the keys 0..n-1 (with the Int64 comparator) and commits it.
+func intList(t testing.TB, nc *NodeCache, n int) *List {
+	l,err := CreateList(nc,Int64)
+	if err!=nil { t.Fatal(err) }
+	for i := 0 ; i<n ; i++ {
+		if err = l.Insert(Int64Key(int64(i)),int64(i)) ; err!=nil { t.Fatal(err) }
+	}
+	if err = nc.Commit() ; err!=nil { t.Fatal(err) }
+	return l
+}
+
+// Collects the values of an iteration.
+func collect(t *testing.T, it *Iterator) (v []int64) {
+	for ok := it.SeekFirst() ; ok ; ok = it.Next() { v = append(v,it.Value()) }
+	it.Close()
+	if it.Err()!=nil { t.Fatal(it.Err()) }
+	return
+}
+func equal(a, b []int64) bool {
+	if len(a)!=len(b) { return false }
+	for i := range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
+
+func TestIterator(t *testing.T) {
+	l := intList(t,newCache(t),50)
+	all := collect(t,NewIterator(l.Cache,l.Head))
+	if len(all)!=50 || all[0]!=0 || all[49]!=49 { t.Fatalf("got %v",all) }
+	if got := collect(t,l.Range(Int64Key(10),Int64Key(13))) ; !equal(got,[]int64{10,11,12}) { t.Fatalf("range got %v",got) }
+	rev := NewReverseIterator(l.Cache,l.Head,Int64Key(10),Int64Key(13))
+	if got := collect(t,rev) ; !equal(got,[]int64{12,11,10}) { t.Fatalf("reverse range got %v",got) }
+}
+
+// Builds a list of the even keys 0,2..2(n-1).
+func evenList(t *testing.T, n int) *List {
+	l,err := CreateList(newCache(t),Int64)
+	if err!=nil { t.Fatal(err) }
+	for i := 0 ; i<n ; i++ {
+		if err = l.Insert(Int64Key(int64(i*2)),int64(i*2)) ; err!=nil { t.Fatal(err) }
+	}
+	return l
+}
+
+func TestIteratorSeek(t *testing.T) {
+	l := evenList(t,10)
+	it := NewIterator(l.Cache,l.Head)
+	defer it.Close()
+	for _,c := range [][2]int64{ {-5,0},{0,0},{3,4},{18,18} } {
+		if !it.Seek(Int64Key(c[0])) || it.Value()!=c[1] { t.Fatalf("Seek(%d) did not find %d",c[0],c[1]) }
+	}
+	if it.Seek(Int64Key(19)) || it.Valid() { t.Fatal("Seek past the end is valid") }
+	if it.Next() { t.Fatal("Next on an invalid iterator") }
+	
+	r := l.Range(Int64Key(5),Int64Key(9))
+	defer r.Close()
+	if !r.Seek(Int64Key(0)) || r.Value()!=6 { t.Fatal("Seek below the range is not clamped to start") }
+	if !r.Next() || r.Value()!=8 || r.Next() { t.Fatal("Range does not end before end") }
+	if r.Seek(Int64Key(9)) { t.Fatal("Seek at end is valid") }
+	if got := collect(t,l.Range(Int64Key(7),Int64Key(8))) ; len(got)!=0 { t.Fatalf("empty range got %v",got) }
+	if got := collect(t,l.Range(nil,Int64Key(4))) ; !equal(got,[]int64{0,2}) { t.Fatalf("open start got %v",got) }
+	if got := collect(t,l.Range(Int64Key(15),nil)) ; !equal(got,[]int64{16,18}) { t.Fatalf("open end got %v",got) }
+}
+
+func TestNavigate(t *testing.T) {
+	l := evenList(t,10)
+	nav := []struct{
+		name string
+		f    func(*NodeCache,int64,[]byte) (*Node,bool,error)
+		cases [][2]int64 // key, expected value (-1: none)
+	}{
+		{"Floor",Floor,[][2]int64{ {-1,-1},{0,0},{5,4},{100,18} }},
+		{"Ceiling",Ceiling,[][2]int64{ {-1,0},{4,4},{5,6},{19,-1} }},
+		{"Lower",Lower,[][2]int64{ {0,-1},{4,2},{5,4},{100,18} }},
+		{"Higher",Higher,[][2]int64{ {-1,0},{4,6},{5,6},{18,-1} }},
+	}
+	for _,n := range nav {
+		for _,c := range n.cases {
+			node,ok,err := n.f(l.Cache,l.Head,Int64Key(c[0]))
+			if err!=nil { t.Fatal(err) }
+			if ok!=(c[1]>=0) || (ok && node.Head.Content!=c[1]) { t.Fatalf("%s(%d): expected %d, got %v %v",n.name,c[0],c[1],ok,node) }
+		}
+	}
+	node,ok,err := Last(l.Cache,l.Head)
+	if err!=nil || !ok || node.Head.Content!=18 { t.Fatalf("Last: %v %v %v",node,ok,err) }
+	
+	empty,err := CreateList(newCache(t),Bytewise)
+	if err!=nil { t.Fatal(err) }
+	if _,ok,err = Last(empty.Cache,empty.Head) ; ok || err!=nil { t.Fatal("Last of an empty list",ok,err) }
+}
+
+func TestReverseIterator(t *testing.T) {
+	l := evenList(t,10)
+	if got := collect(t,NewReverseIterator(l.Cache,l.Head,nil,nil)) ; !equal(got,[]int64{18,16,14,12,10,8,6,4,2,0}) { t.Fatalf("got %v",got) }
+	if got := collect(t,NewReverseIterator(l.Cache,l.Head,Int64Key(3),Int64Key(8))) ; !equal(got,[]int64{6,4}) { t.Fatalf("range got %v",got) }
+	it := NewReverseIterator(l.Cache,l.Head,nil,Int64Key(10))
+	defer it.Close()
+	if !it.Seek(Int64Key(5)) || it.Value()!=4 { t.Fatal("Seek does not move to the floor") }
+	if !it.Seek(Int64Key(12)) || it.Value()!=8 { t.Fatal("Seek beyond end does not move to the last element") }
+	if it.Seek(Int64Key(-1)) { t.Fatal("Seek before the first element is valid") }
+	
+	// Duplicate keys are visited value by value.
+	m := l.MultiMap()
+	for _,v := range []int64{7,3} {
+		if err := m.Insert(Int64Key(4),v) ; err!=nil { t.Fatal(err) }
+	}
+	if got := collect(t,NewReverseIterator(l.Cache,l.Head,Int64Key(4),Int64Key(5))) ; !equal(got,[]int64{7,4,3}) { t.Fatalf("duplicates got %v",got) }
+}
+
+// A file, whose reads are slow.
+type slowFile struct{
+	file.File
+	delay *time.Duration
+}
+func (f slowFile) ReadAt(p []byte, off int64) (int,error) {
+	time.Sleep(*f.delay)
+	return f.File.ReadAt(p,off)
+}
+
+// Iterates over 200 nodes with 50us per read and 50us of work per element.
+func benchmarkIterate(b *testing.B, ahead int) {
+	var delay time.Duration
+	dm,err := dataman.NewSimpleDataManager(slowFile{tempFile(b),&delay})
+	if err!=nil { b.Fatal(err) }
+	l := intList(b,NodeMaster.Open(dm,false),200)
+	delay = 50*time.Microsecond
+	b.ResetTimer()
+	for i := 0 ; i<b.N ; i++ {
+		it := NewIterator(NodeMaster.Open(dm,true),l.Head)
+		it.SetReadAhead(ahead)
+		for ok := it.SeekFirst() ; ok ; ok = it.Next() { time.Sleep(50*time.Microsecond) }
+		it.Close()
+		if it.Err()!=nil { b.Fatal(it.Err()) }
+	}
+}
+func BenchmarkIterate(b *testing.B) { benchmarkIterate(b,-1) }
+func BenchmarkIterateReadAhead(b *testing.B) { benchmarkIterate(b,0) }
@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/maxymania/gobase/blocklist"
+import "errors"
+import "math"
+
+var EValueTooLarge = errors.New("EValueTooLarge")
+
+// The maximum size of a value, that is stored inside its node.
+const DefaultInline = 256
+
+/*
+A skiplist, whose nodes carry []byte values. Values up to Inline bytes are stored inside
+the node, so that a lookup needs no additional read; larger ones in a blocklist chain.
+
+In a KV list, Head.Content points to the chain, so its nodes must not be modified
+through the int64 API.
+*/
+type KV struct{
+	Cache  *NodeCache
+	Head   int64
+	
+	// Zero means DefaultInline.
+	Inline int
+}
+
+func (kv *KV) inline() int {
+	if kv.Inline<=0 { return DefaultInline }
+	return kv.Inline
+}
+// The size of the encoded value section.
+func (kv *KV) section(n int) int {
+	if n>kv.inline() { return 4 }
+	return 4+n
+}
+func section(n *Node) int {
+	if n.Overflow!=0 { return 4 }
+	if n.Value!=nil { return 4+len(n.Value) }
+	return 0
+}
+
+// Assigns value to n. The previous value, if any, must have been released.
+func (kv *KV) setValue(n *Node, value []byte) error {
+	if len(value)<=kv.inline() {
+		n.Value = append(make([]byte,0,len(value)),value...)
+		n.Overflow = 0
+		n.Head.Content = 0
+		return nil
+	}
+	if len(value)>math.MaxInt32 { return EValueTooLarge }
+	var off int64
+	err := kv.Cache.WithDataManager(func(dm dataman.DataManager) (err error) {
+		off,err = blocklist.WriteChain(dm,value)
+		return
+	})
+	if err!=nil { return err }
+	n.Value = nil
+	n.Overflow = int32(len(value))
+	n.Head.Content = off
+	return nil
+}
+func (kv *KV) freeValue(overflow int32, chain int64) error {
+	if overflow==0 { return nil }
+	return kv.Cache.WithDataManager(func(dm dataman.DataManager) error {
+		return blocklist.FreeChain(dm,chain)
+	})
+}
+
+// Returns a copy of the value of n.
+func (kv *KV) Value(n *Node) ([]byte,error) {
+	if n.Overflow==0 { return append([]byte(nil),n.Value...),nil }
+	buf := make([]byte,0,n.Overflow)
+	err := kv.Cache.WithDataManager(func(dm dataman.DataManager) (err error) {
+		f := dm.RollbackFile()
+		if kv.Cache.ReadOnly() { f = dm.DirectFile() }
+		buf,err = blocklist.ReadChain(f,n.Head.Content,buf)
+		return
+	})
+	return buf,err
+}
+
+func (kv *KV) Get(key []byte) ([]byte,bool,error) {
+	node,ok,err := LookupNode(kv.Cache,kv.Head,key)
+	if !ok { return nil,false,err }
+	v,err := kv.Value(node)
+	return v,err==nil,err
+}
+
+// Inserts or replaces the value of key.
+func (kv *KV) Put(key, value []byte) error {
+	nc := kv.Cache
+	ks := KeySearcher{Cache:nc}
+	err := ks.Steps(kv.Head,key)
+	if err!=nil { return err }
+	ref,node,ok,err := ks.foundRef(key)
+	if err!=nil { return err }
+	
+	if ok && kv.section(len(value))<=section(node) {
+		// The node doesn't grow: Update it in place.
+		node,err = nc.Pin(ref)
+		if err!=nil { return err }
+		defer nc.Unpin(ref)
+		overflow,chain := node.Overflow,node.Head.Content
+		err = kv.setValue(node,value)
+		if err!=nil { return err }
+		node.Tainted = true
+		return kv.freeValue(overflow,chain)
+	}
+	
+	n := &Node{Key:key}
+	err = kv.setValue(n,value)
+	if err!=nil { return err }
+	if ok {
+		// Replace the node, after the new value has been written.
+		overflow,chain := node.Overflow,node.Head.Content
+		err = ks.replace(ref,n)
+		if err==nil { return kv.freeValue(overflow,chain) }
+	} else {
+		_,err = ks.insert(n,randomLevel())
+	}
+	if err!=nil { kv.freeValue(n.Overflow,n.Head.Content) }
+	return err
+}
+
+func (kv *KV) Delete(key []byte) (bool,error) {
+	ks := KeySearcher{Cache:kv.Cache}
+	err := ks.Steps(kv.Head,key)
+	if err!=nil { return false,err }
+	ref,node,ok,err := ks.foundRef(key)
+	if !ok { return false,err }
+	overflow,chain := node.Overflow,node.Head.Content
+	err = ks.remove(ref,node)
+	if err!=nil { return false,err }
+	return true,kv.freeValue(overflow,chain)
+}
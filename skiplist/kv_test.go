@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "github.com/maxymania/gobase/dataman"
+import "bytes"
+import "errors"
+import "testing"
+
+var errAlloc = errors.New("alloc failed")
+
+// A DataManager, whose Alloc fails on demand.
+type failingAlloc struct{
+	*dataman.SimpleDataManager
+	fail bool
+}
+func (f *failingAlloc) Alloc(size int64) (int64,error) {
+	if f.fail { return 0,errAlloc }
+	return f.SimpleDataManager.Alloc(size)
+}
+
+func TestKV(t *testing.T) {
+	dm,err := dataman.NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	l,err := CreateList(NodeMaster.Open(dm,false),Bytewise)
+	if err!=nil { t.Fatal(err) }
+	kv := l.KV()
+	kv.Inline = 8
+	small,large := []byte("small"),bytes.Repeat([]byte("large"),1000)
+	values := map[string][]byte{ "a":small, "b":large, "c":small, "d":large }
+	for _,k := range []string{"a","b","c","d"} {
+		if err = kv.Put([]byte(k),values[k]) ; err!=nil { t.Fatal(err) }
+	}
+	
+	// Grow (replaces the node), shrink (in place) and delete.
+	values["a"],values["b"] = large,small
+	if err = kv.Put([]byte("a"),large) ; err!=nil { t.Fatal(err) }
+	if err = kv.Put([]byte("b"),small) ; err!=nil { t.Fatal(err) }
+	if ok,err := kv.Delete([]byte("c")) ; !ok || err!=nil { t.Fatal("Delete",ok,err) }
+	delete(values,"c")
+	if ok,err := kv.Delete([]byte("c")) ; ok || err!=nil { t.Fatal("Delete of a deleted key",ok,err) }
+	if err = l.Cache.Commit() ; err!=nil { t.Fatal(err) }
+	
+	kv = (&List{Cache:NodeMaster.Open(dm,false),Head:l.Head}).KV()
+	var keys []string
+	it := NewIterator(kv.Cache,kv.Head)
+	for ok := it.SeekFirst() ; ok ; ok = it.Next() { keys = append(keys,string(it.Key())) }
+	it.Close()
+	if it.Err()!=nil || len(keys)!=3 || keys[0]!="a" || keys[1]!="b" || keys[2]!="d" { t.Fatalf("keys %v %v",keys,it.Err()) }
+	for k,v := range values {
+		got,ok,err := kv.Get([]byte(k))
+		if err!=nil || !ok || !bytes.Equal(got,v) { t.Fatalf("Get(%q): %v %v, %d bytes",k,ok,err,len(got)) }
+	}
+	if _,ok,err := kv.Get([]byte("c")) ; ok || err!=nil { t.Fatal("Get of a deleted key",ok,err) }
+}
+
+// A failed replacement must leave the old node in place.
+func TestKVReplaceFailure(t *testing.T) {
+	sdm,err := dataman.NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	dm := &failingAlloc{SimpleDataManager:sdm}
+	l,err := CreateList(NodeMaster.Open(dm,false),Bytewise)
+	if err!=nil { t.Fatal(err) }
+	kv := l.KV()
+	kv.Inline = 8
+	if err = kv.Put([]byte("key"),[]byte("old")) ; err!=nil { t.Fatal(err) }
+	if err = kv.Put([]byte("other"),[]byte("x")) ; err!=nil { t.Fatal(err) }
+	dm.fail = true
+	if err = kv.Put([]byte("key"),[]byte("new val")) ; err!=errAlloc { t.Fatal("expected the Alloc error, got",err) }
+	dm.fail = false
+	got,ok,err := kv.Get([]byte("key"))
+	if err!=nil || !ok || string(got)!="old" { t.Fatalf("got %q %v %v",got,ok,err) }
+	if got,ok,err = kv.Get([]byte("other")) ; err!=nil || !ok || string(got)!="x" { t.Fatalf("got %q %v %v",got,ok,err) }
+}
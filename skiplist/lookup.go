@@ -23,18 +23,15 @@ SOFTWARE.
 
 package skiplist
 
-import "github.com/maxymania/gobase/genericstruct"
-import "bytes"
 
-
-func LookupNode(nc *genericstruct.NodeCache,off int64,key []byte) (*Node,bool,error) {
+func LookupNode(nc *NodeCache,off int64,key []byte) (*Node,bool,error) {
 	ks := KeySearcher{Cache:nc}
 	_,node,err := ks.StepsFind(off,key)
 	if err!=nil { return nil,false,err }
 	return node,node!=nil,nil
 }
 
-func Lookup(nc *genericstruct.NodeCache,off int64,key []byte) (int64,bool,error) {
+func Lookup(nc *NodeCache,off int64,key []byte) (int64,bool,error) {
 	ks := KeySearcher{Cache:nc}
 	_,node,err := ks.StepsFind(off,key)
 	if err!=nil { return 0,false,err }
@@ -43,25 +40,61 @@ func Lookup(nc *genericstruct.NodeCache,off int64,key []byte) (int64,bool,error)
 }
 
 
-func Delete(nc *genericstruct.NodeCache,off int64,key []byte) (bool,error) {
+func Delete(nc *NodeCache,off int64,key []byte) (bool,error) {
 	ks := KeySearcher{Cache:nc}
 	err := ks.Steps(off,key)
 	if err!=nil { return false,err }
 	ref,node,ok,err := ks.foundRef(key) // nc[ref] => node
 	if err!=nil { return false,err }
 	if !ok { return false,nil }
+	return true,ks.remove(ref,node)
+}
+
+// Unlinks and frees the node ref. k.Steps() must have been called with its key before.
+func (k *KeySearcher) remove(ref int64, node *Node) error {
+	nc := k.Cache
+	node,err := nc.Pin(ref)
+	if err!=nil { return err }
 	// This loop untethers all Links to the current node.
 	for i:=0 ; i<Steps ; i++ {
-		nb,err := nc.Get(ks.Ptrs[i])
-		if err!=nil { return false,err }
-		nnode := nb.(*Node)
+		nnode,err := nc.Pin(k.Ptrs[i])
+		if err!=nil { nc.Unpin(ref); return err }
+		nnode.unlink(i,ref,node)
+		nc.Unpin(k.Ptrs[i])
+	}
+	nc.Unpin(ref)
+	err = nc.WriteBack() // Write back the cache, without purging it.
+	if err!=nil { return err }
+	return nc.Delete(ref)
+}
+
+/*
+Replaces the node ref by n, which takes over its links. k.Steps() must have been called with its
+key before. n is written, before any link is redirected to it, so that the list is unchanged, if
+that fails.
+*/
+func (k *KeySearcher) replace(ref int64, n *Node) error {
+	nc := k.Cache
+	node,err := nc.Pin(ref)
+	if err!=nil { return err }
+	n.Head.Nexts = node.Head.Nexts
+	if node.Spans!=nil { n.Spans = append([]uint32(nil),node.Spans...) }
+	noff,err := nc.Set(n)
+	if err!=nil { nc.Unpin(ref); return err }
+	// This loop redirects all Links from the current node to the new one.
+	for i:=0 ; i<Steps ; i++ {
+		nnode,err := nc.Pin(k.Ptrs[i])
+		if err!=nil { nc.Unpin(ref); return err }
 		if nnode.Head.Nexts[i]==ref {
-			nnode.Head.Nexts[i] = node.Head.Nexts[i]
+			nnode.Head.Nexts[i] = noff
 			nnode.Tainted = true
 		}
+		nc.Unpin(k.Ptrs[i])
 	}
-	nc.Flush() // Flush the cache.
-	return true,nc.Delete(ref)
+	nc.Unpin(ref)
+	err = nc.WriteBack() // Write back the cache, without purging it.
+	if err!=nil { return err }
+	return nc.Delete(ref)
 }
 
 /*
@@ -70,27 +103,27 @@ Removes the first Element of the skiplist, if it is lower or equal to KEY.
 On success, it returns the Value, that is assigned to the first element.
 On failure (first element is greater than KEY, or list is empty), it does not modify anything.
 */
-func ConsumeFirstIfLowerOrEqual(nc *genericstruct.NodeCache,off int64,key []byte) (int64,bool,error) {
-	b,err := nc.Get(off)
+func ConsumeFirstIfLowerOrEqual(nc *NodeCache,off int64,key []byte) (int64,bool,error) {
+	root,err := nc.Pin(off)
 	if err!=nil { return 0,false,err }
-	root := b.(*Node)
+	defer nc.Unpin(off)
 	ref := root.Head.Nexts[0]
 	if ref==0 { return 0,false,nil } // No first node (list empty)
-	b,err = nc.Get(ref)
+	first,err := nc.Get(ref)
+	if err!=nil { return 0,false,err }
+	cmp,err := root.comparator()
 	if err!=nil { return 0,false,err }
-	first := b.(*Node)
-	if bytes.Compare(first.Key,key)>0 { return 0,false,nil } // first element is greater than KEY
+	if cmp(first.Key,key)>0 { return 0,false,nil } // first element is greater than KEY
 	
 	value := first.Head.Content
 	
-	for i:=0 ; i<Steps ; i++ {
-		if root.Head.Nexts[i]==ref { root.Head.Nexts[i] = first.Head.Nexts[i] }
-	}
+	for i:=0 ; i<Steps ; i++ { root.unlink(i,ref,first) }
 	root.Tainted = true
 	
-	nc.Flush() // Flush the cache.
+	err = nc.WriteBack() // Write back the cache, without purging it.
+	if err!=nil { return 0,false,err }
 	
-	return value,false,nc.Delete(ref)
+	return value,true,nc.Delete(ref)
 }
 
 
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+/*
+A skiplist with duplicate keys: The (key,value) pairs are unique, and ordered by key,
+then by value. A multimap must only be modified through MultiMap (or Delete and
+ConsumeFirstIfLowerOrEqual, which remove an arbitrary or the first pair of a key).
+*/
+type MultiMap struct{
+	Cache *NodeCache
+	Head  int64
+}
+
+func (l *List) MultiMap() *MultiMap { return &MultiMap{l.Cache,l.Head} }
+
+// Searches the pair. Returns its node, if it exists.
+func (m *MultiMap) find(ks *KeySearcher, key []byte, value int64) (int64,*Node,error) {
+	ref,node,err := ks.ceilingPair(m.Head,key,value)
+	if err!=nil || ref==0 || ks.comparePair(node,key,value)!=0 { return 0,nil,err }
+	return ref,node,nil
+}
+
+// Inserts the pair. Returns EExists, if it exists already.
+func (m *MultiMap) Insert(key []byte, value int64) error {
+	ks := KeySearcher{Cache:m.Cache}
+	ref,_,err := m.find(&ks,key,value)
+	if err!=nil { return err }
+	if ref!=0 { return EExists }
+	_,err = ks.Insert(key,value,randomLevel())
+	return err
+}
+
+func (m *MultiMap) Has(key []byte, value int64) (bool,error) {
+	ks := KeySearcher{Cache:m.Cache}
+	ref,_,err := m.find(&ks,key,value)
+	return ref!=0,err
+}
+
+// Removes the pair. Returns false, if it doesn't exist.
+func (m *MultiMap) DeleteExact(key []byte, value int64) (bool,error) {
+	ks := KeySearcher{Cache:m.Cache}
+	ref,node,err := m.find(&ks,key,value)
+	if err!=nil || ref==0 { return false,err }
+	return true,ks.remove(ref,node)
+}
+
+// Iterates over the values of key, in ascending order.
+func (m *MultiMap) GetAll(key []byte) *Iterator {
+	it := NewRangeIterator(m.Cache,m.Head,key,key)
+	it.incl = true
+	return it
+}
@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "math/rand"
+import "testing"
+
+func TestMultiMap(t *testing.T) {
+	l,err := CreateList(newCache(t),Bytewise)
+	if err!=nil { t.Fatal(err) }
+	m := l.MultiMap()
+	for _,v := range rand.Perm(20) {
+		for _,k := range []string{"a","b","c"} {
+			if err = m.Insert([]byte(k),int64(v)) ; err!=nil { t.Fatal(err) }
+		}
+	}
+	if err = m.Insert([]byte("b"),7) ; err!=EExists { t.Fatal("expected EExists for an existing pair, got",err) }
+	for _,v := range []int64{0,7,19} {
+		if ok,err := m.DeleteExact([]byte("b"),v) ; !ok || err!=nil { t.Fatal("DeleteExact",v,ok,err) }
+	}
+	if ok,err := m.DeleteExact([]byte("b"),7) ; ok || err!=nil { t.Fatal("DeleteExact of a deleted pair",ok,err) }
+	if ok,err := m.Has([]byte("b"),7) ; ok || err!=nil { t.Fatal("Has of a deleted pair",ok,err) }
+	if ok,err := m.Has([]byte("c"),7) ; !ok || err!=nil { t.Fatal("Has",ok,err) }
+	
+	var expect []int64
+	for v := int64(1) ; v<19 ; v++ {
+		if v!=7 { expect = append(expect,v) }
+	}
+	if got := collect(t,m.GetAll([]byte("b"))) ; !equal(got,expect) { t.Fatalf("GetAll got %v",got) }
+	if got := collect(t,m.GetAll([]byte("x"))) ; len(got)!=0 { t.Fatalf("GetAll of a missing key got %v",got) }
+	if got := collect(t,l.Range([]byte("c"),nil)) ; len(got)!=20 || got[0]!=0 || got[19]!=19 { t.Fatalf("Range got %v",got) }
+}
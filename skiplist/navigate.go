@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "math"
+
+/*
+Navigation relative to a key. Each of these performs a single search, so stepping
+backwards through the list costs O(log n) per step, as there are no backward pointers.
+*/
+
+// Finds the last node. Returns 0, if the list is empty.
+func (k *KeySearcher) last(off int64) (int64,error) {
+	node,err := k.Cache.Get(off)
+	if err!=nil { return 0,err }
+	k.cmp,err = node.comparator()
+	if err!=nil { return 0,err }
+	k.indexed = node.Spans!=nil
+	ref := off
+	pos := int64(0)
+	for i := Steps-1 ; 0<=i ; i-- {
+		for node.Head.Nexts[i]!=0 {
+			next := node.Head.Nexts[i]
+			pos += node.span(i)
+			node,err = k.Cache.Get(next)
+			if err!=nil { return 0,err }
+			ref = next
+		}
+		k.Ptrs[i],k.Ranks[i] = ref,pos
+	}
+	if ref==off { return 0,nil }
+	return ref,nil
+}
+// Finds the last node before (key,value). Returns 0, if there is none.
+func (k *KeySearcher) lowerPair(off int64, key []byte, value int64) (int64,error) {
+	err := k.StepsPair(off,key,value)
+	if err!=nil { return 0,err }
+	if k.Ptrs[0]==off { return 0,nil }
+	return k.Ptrs[0],nil
+}
+// Finds the first node at or after (key,value). Returns 0, if there is none.
+func (k *KeySearcher) ceilingPair(off int64, key []byte, value int64) (int64,*Node,error) {
+	err := k.StepsPair(off,key,value)
+	if err!=nil { return 0,nil,err }
+	node,err := k.Cache.Get(k.Ptrs[0])
+	if err!=nil { return 0,nil,err }
+	next := node.Head.Nexts[0]
+	if next==0 { return 0,nil,nil }
+	node,err = k.Cache.Get(next)
+	if err!=nil { return 0,nil,err }
+	return next,node,nil
+}
+// Finds the last node, whose key is lower than key. Returns 0, if there is none.
+func (k *KeySearcher) lower(off int64, key []byte) (int64,error) {
+	return k.lowerPair(off,key,math.MinInt64)
+}
+// Finds the first node, whose key is greater than or equal to key. Returns 0, if there is none.
+func (k *KeySearcher) ceiling(off int64, key []byte) (int64,*Node,error) {
+	return k.ceilingPair(off,key,math.MinInt64)
+}
+// Finds the last node, whose key is lower than or equal to key. Returns 0, if there is none.
+func (k *KeySearcher) floor(off int64, key []byte) (int64,error) {
+	ref,node,err := k.ceilingPair(off,key,math.MaxInt64)
+	if err!=nil { return 0,err }
+	if ref!=0 && k.comparePair(node,key,math.MaxInt64)==0 { return ref,nil }
+	if k.Ptrs[0]==off { return 0,nil }
+	return k.Ptrs[0],nil
+}
+// Finds the first node, whose key is greater than key. Returns 0, if there is none.
+func (k *KeySearcher) higher(off int64, key []byte) (int64,error) {
+	ref,node,err := k.ceilingPair(off,key,math.MaxInt64)
+	if err!=nil { return 0,err }
+	if ref!=0 && k.comparePair(node,key,math.MaxInt64)==0 { return node.Head.Nexts[0],nil }
+	return ref,nil
+}
+
+func nodeAt(nc *NodeCache,ref int64,err error) (*Node,bool,error) {
+	if err!=nil || ref==0 { return nil,false,err }
+	node,err := nc.Get(ref)
+	if err!=nil { return nil,false,err }
+	return node,true,nil
+}
+
+// Returns the node with the greatest key.
+func Last(nc *NodeCache,off int64) (*Node,bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,err := ks.last(off)
+	return nodeAt(nc,ref,err)
+}
+// Returns the node with the greatest key lower than or equal to key.
+func Floor(nc *NodeCache,off int64,key []byte) (*Node,bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,err := ks.floor(off,key)
+	return nodeAt(nc,ref,err)
+}
+// Returns the node with the least key greater than or equal to key.
+func Ceiling(nc *NodeCache,off int64,key []byte) (*Node,bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,node,err := ks.ceiling(off,key)
+	if err!=nil || ref==0 { return nil,false,err }
+	return node,true,nil
+}
+// Returns the node with the greatest key strictly lower than key.
+func Lower(nc *NodeCache,off int64,key []byte) (*Node,bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,err := ks.lower(off,key)
+	return nodeAt(nc,ref,err)
+}
+// Returns the node with the least key strictly greater than key.
+func Higher(nc *NodeCache,off int64,key []byte) (*Node,bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,err := ks.higher(off,key)
+	return nodeAt(nc,ref,err)
+}
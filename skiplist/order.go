@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "errors"
+import "math"
+
+var ENotIndexed = errors.New("ENotIndexed")
+
+/*
+Creates an empty indexed skiplist. An indexed list maintains the widths of its links,
+which allows Rank, Select, Len and CountRange in O(log n). It holds up to 2^32-1 keys.
+*/
+func CreateIndexedList(nc *NodeCache, cmp string) (*List,error) {
+	return createList(nc,&Node{Spans:make([]uint32,Steps)},cmp)
+}
+
+// Returns the number of keys lower than key.
+func Rank(nc *NodeCache,off int64,key []byte) (int64,error) {
+	ks := KeySearcher{Cache:nc}
+	err := ks.Steps(off,key)
+	if err!=nil { return 0,err }
+	if !ks.indexed { return 0,ENotIndexed }
+	return ks.Ranks[0],nil
+}
+
+// Walks to the node at the position pos, or to the last one before it. The head is at 0.
+func walk(nc *NodeCache,off int64,pos int64) (*Node,int64,error) {
+	node,err := nc.Get(off)
+	if err!=nil { return nil,0,err }
+	if node.Spans==nil { return nil,0,ENotIndexed }
+	cur := int64(0)
+	for i := Steps-1 ; 0<=i ; i-- {
+		for node.Head.Nexts[i]!=0 && cur+node.span(i)<=pos {
+			cur += node.span(i)
+			node,err = nc.Get(node.Head.Nexts[i])
+			if err!=nil { return nil,0,err }
+		}
+		if cur==pos { break }
+	}
+	return node,cur,nil
+}
+
+// Returns the node at index i (starting at 0).
+func Select(nc *NodeCache,off int64,i int64) (*Node,bool,error) {
+	if i<0 || i==math.MaxInt64 { return nil,false,nil }
+	node,pos,err := walk(nc,off,i+1)
+	if err!=nil || pos!=i+1 { return nil,false,err }
+	return node,true,nil
+}
+
+// Returns the number of keys.
+func Len(nc *NodeCache,off int64) (int64,error) {
+	_,pos,err := walk(nc,off,math.MaxInt64)
+	return pos,err
+}
+
+// Returns the number of keys in [a,b).
+func CountRange(nc *NodeCache,off int64,a, b []byte) (int64,error) {
+	ra,err := Rank(nc,off,a)
+	if err!=nil { return 0,err }
+	rb,err := Rank(nc,off,b)
+	if err!=nil || rb<ra { return 0,err }
+	return rb-ra,nil
+}
+
+func (l *List) Rank(key []byte) (int64,error) { return Rank(l.Cache,l.Head,key) }
+func (l *List) Select(i int64) (*Node,bool,error) { return Select(l.Cache,l.Head,i) }
+func (l *List) Len() (int64,error) { return Len(l.Cache,l.Head) }
+func (l *List) CountRange(a, b []byte) (int64,error) { return CountRange(l.Cache,l.Head,a,b) }
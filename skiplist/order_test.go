@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "math/rand"
+import "sort"
+import "testing"
+
+// Compares the order statistics of l with the sorted keys.
+func checkOrder(t *testing.T, l *List, keys []int64) {
+	t.Helper()
+	n,err := l.Len()
+	if err!=nil || n!=int64(len(keys)) { t.Fatalf("Len: %d %v, expected %d",n,err,len(keys)) }
+	for i,k := range keys {
+		node,ok,err := l.Select(int64(i))
+		if err!=nil || !ok || node.Head.Content!=k { t.Fatalf("Select(%d): %v %v, expected %d",i,ok,err,k) }
+		r,err := l.Rank(Int64Key(k))
+		if err!=nil || r!=int64(i) { t.Fatalf("Rank(%d): %d %v, expected %d",k,r,err,i) }
+	}
+	if _,ok,err := l.Select(int64(len(keys))) ; ok || err!=nil { t.Fatal("Select past the end",ok,err) }
+	if _,ok,err := l.Select(-1) ; ok || err!=nil { t.Fatal("Select(-1)",ok,err) }
+	for i := 0 ; i<20 ; i++ {
+		a,b := rand.Int63n(1000)-10,rand.Int63n(1000)-10
+		expect := int64(sort.Search(len(keys),func(i int) bool { return keys[i]>=b })-sort.Search(len(keys),func(i int) bool { return keys[i]>=a }))
+		if expect<0 { expect = 0 }
+		if got,err := l.CountRange(Int64Key(a),Int64Key(b)) ; err!=nil || got!=expect { t.Fatalf("CountRange(%d,%d): %d %v, expected %d",a,b,got,err,expect) }
+	}
+}
+
+func TestOrderStatistics(t *testing.T) {
+	dm,nc := newDataManager(t)
+	l,err := CreateIndexedList(nc,Int64)
+	if err!=nil { t.Fatal(err) }
+	checkOrder(t,l,nil)
+	set := make(map[int64]bool)
+	for _,k := range rand.Perm(500) {
+		if err = l.Insert(Int64Key(int64(k*2)),int64(k*2)) ; err!=nil { t.Fatal(err) }
+		set[int64(k*2)] = true
+	}
+	for _,k := range rand.Perm(500)[:200] {
+		if _,err = l.Delete(Int64Key(int64(k*2))) ; err!=nil { t.Fatal(err) }
+		delete(set,int64(k*2))
+	}
+	var keys []int64
+	for k := range set { keys = append(keys,k) }
+	sort.Slice(keys,func(i, j int) bool { return keys[i]<keys[j] })
+	checkOrder(t,l,keys)
+	
+	if err = nc.Commit() ; err!=nil { t.Fatal(err) }
+	checkOrder(t,&List{NodeMaster.Open(dm,false),l.Head},keys)
+}
+
+func TestNotIndexed(t *testing.T) {
+	l := intList(t,newCache(t),3)
+	if _,err := l.Rank(Int64Key(1)) ; err!=ENotIndexed { t.Fatal("Rank",err) }
+	if _,_,err := l.Select(0) ; err!=ENotIndexed { t.Fatal("Select",err) }
+	if _,err := l.Len() ; err!=ENotIndexed { t.Fatal("Len",err) }
+}
+
+// Replacing a KV node keeps the link widths.
+func TestOrderKVReplace(t *testing.T) {
+	l,err := CreateIndexedList(newCache(t),Int64)
+	if err!=nil { t.Fatal(err) }
+	kv := l.KV()
+	for i := int64(0) ; i<50 ; i++ {
+		if err = kv.Put(Int64Key(i),nil) ; err!=nil { t.Fatal(err) }
+	}
+	for i := int64(0) ; i<50 ; i+=3 {
+		if err = kv.Put(Int64Key(i),[]byte("a longer value")) ; err!=nil { t.Fatal(err) }
+	}
+	if n,err := l.Len() ; n!=50 || err!=nil { t.Fatal("Len",n,err) }
+	for i := int64(0) ; i<50 ; i++ {
+		node,ok,err := l.Select(i)
+		if err!=nil || !ok || compareInt64(node.Key,Int64Key(i))!=0 { t.Fatalf("Select(%d): %v %v",i,ok,err) }
+	}
+}
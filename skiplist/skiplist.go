@@ -24,14 +24,55 @@ SOFTWARE.
 package skiplist
 
 import "encoding/binary"
-import "bytes"
 import "github.com/valyala/bytebufferpool"
 import "github.com/maxymania/gobase/genericstruct"
 import "errors"
+import "math"
 
 const Steps = 20
 
-var NodeMaster = &genericstruct.NodeMaster{Factory:NodeConstructor}
+/*
+The schema tag ("SL") and version of skiplist nodes. Nodes written before schemas were introduced are version 1.
+
+Version 2 adds an optional value section [ VLen:4 | Value ] after the key, marked by hasValue in Rest.
+A node without value is encoded exactly as in version 1.
+
+Version 3 adds an optional span section [ N:1 | Spans:4*N ] after the value, marked by hasSpans in Rest.
+
+Version 4 adds an optional comparator section [ N:1 | Name ] after the spans, marked by hasComparator
+in Rest. Lists, whose head has no such section (including all older ones), are bytewise.
+*/
+const (
+	SchemaTag     = 0x534c
+	SchemaVersion = 4
+)
+
+var NodeMaster = &genericstruct.NodeMasterOf[*Node]{
+	Factory:NodeConstructor,
+	Tag:SchemaTag,
+	Version:SchemaVersion,
+	LegacyVersion:1,
+}
+
+func init() {
+	for v := uint8(1) ; v<SchemaVersion ; v++ {
+		genericstruct.RegisterDecoder(SchemaTag,v,func(b genericstruct.Block, buf *bytebufferpool.ByteBuffer) {
+			b.(*Node).Load(buf)
+		})
+	}
+}
+
+const (
+	// Flags in NodeHead.Rest: The value, span or comparator section is present.
+	hasValue = 1<<30
+	hasSpans = 1<<29
+	hasComparator = 1<<28
+	
+	// Flag in VLen: The value is stored in a blocklist chain at NodeHead.Content.
+	overflow = 1<<31
+)
+
+type NodeCache = genericstruct.NodeCacheOf[*Node]
 
 var EExists = errors.New("EExists")
 
@@ -41,61 +82,232 @@ type NodeHead struct{
 	Rest    int32
 }
 
+// The links of all levels, Content and Rest, laid out like binary.Write lays out NodeHead.
+const HeadSize = Steps*8+8+4
+
+// Decodes the head from b and returns the remainder. A truncated head is decoded as zero.
+func (h *NodeHead) decode(b []byte) []byte {
+	if len(b)<HeadSize { *h = NodeHead{}; return nil }
+	for i := range h.Nexts { h.Nexts[i] = int64(binary.BigEndian.Uint64(b[i*8:])) }
+	h.Content = int64(binary.BigEndian.Uint64(b[Steps*8:]))
+	h.Rest    = int32(binary.BigEndian.Uint32(b[Steps*8+8:]))
+	return b[HeadSize:]
+}
+func (h *NodeHead) encode(b []byte) {
+	for i,p := range h.Nexts { binary.BigEndian.PutUint64(b[i*8:],uint64(p)) }
+	binary.BigEndian.PutUint64(b[Steps*8:],uint64(h.Content))
+	binary.BigEndian.PutUint32(b[Steps*8+8:],uint32(h.Rest))
+}
+
 type Node struct{
 	Head    NodeHead
 	Key     []byte
+	
+	// The inline value. If Overflow is non-zero, the value has Overflow bytes and
+	// is stored in a blocklist chain at Head.Content instead.
+	Value    []byte
+	Overflow int32
+	
+	/*
+	The widths of the links (the number of nodes, they skip, plus one) in an indexed list.
+	Its length is the height of the node, it is nil in lists, that aren't indexed.
+	*/
+	Spans   []uint32
+	
+	// The name of the comparator of the list. Only set in head nodes.
+	Comparator string
+	
 	Tainted bool
 }
-func NodeConstructor() genericstruct.Block { return new(Node) }
+func NodeConstructor() *Node { return new(Node) }
+
+func (n *Node) hasValue() bool { return n.Overflow!=0 || n.Value!=nil }
+
+func (n *Node) span(i int) int64 {
+	if i<len(n.Spans) { return int64(n.Spans[i]) }
+	return 0
+}
+// Updates the link at level i for the removal of the node ref.
+func (n *Node) unlink(i int, ref int64, node *Node) {
+	if n.Head.Nexts[i]==ref {
+		n.Head.Nexts[i] = node.Head.Nexts[i]
+		if i<len(n.Spans) {
+			if n.Head.Nexts[i]==0 {
+				n.Spans[i] = 0
+			} else {
+				n.Spans[i] += uint32(node.span(i))-1
+			}
+		}
+		n.Tainted = true
+	} else if n.Head.Nexts[i]!=0 && i<len(n.Spans) {
+		n.Spans[i]--
+		n.Tainted = true
+	}
+}
+
+/*
+Decodes the node. A truncated Key is zero-padded to its stored length.
+
+The cache creates a new Node for every miss, its Key and inline Value are carved out of
+a single allocation. If a cached Node is loaded again, Key, Value and Spans keep their
+storage, unless it is too small.
+*/
 func (n *Node) Load(buf *bytebufferpool.ByteBuffer) {
-	src := bytes.NewReader(buf.B)
-	binary.Read(src,binary.BigEndian,&(n.Head))
-	n.Key = make([]byte,int(n.Head.Rest))
-	src.Read(n.Key)
+	rest := n.Head.decode(buf.B)
+	flags := n.Head.Rest&(hasValue|hasSpans|hasComparator)
+	if n.Head.Rest<0 { flags = 0 }
+	l := int(n.Head.Rest&^flags)
+	if l<0 { l = 0 }
+	key := rest
+	if l<len(key) { key = key[:l] }
+	rest = rest[len(key):]
+	
+	var value []byte
+	inline,ovf := false,int32(0)
+	if flags&hasValue!=0 && len(rest)>=4 {
+		vl := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if vl&overflow!=0 {
+			ovf = int32(vl&^overflow)
+		} else {
+			if int(vl)>len(rest) { vl = uint32(len(rest)) }
+			value,rest = rest[:vl],rest[vl:]
+			inline = true
+		}
+	}
+	
+	if n.Key==nil && n.Value==nil {
+		// Key and an inline Value share one allocation.
+		b := make([]byte,l+len(value))
+		n.Key,n.Value = b[:0:l],b[l:l]
+	}
+	n.Key = genericstruct.Fill(n.Key,key,l)
+	v := n.Value[:0]
+	if v==nil { v = []byte{} }
+	n.Value,n.Overflow = nil,ovf
+	if inline { n.Value = append(v,value...) }
+	
+	sp := n.Spans[:0]
+	n.Spans = nil
+	if flags&hasSpans!=0 && len(rest)>=1 {
+		h := int(rest[0])
+		rest = rest[1:]
+		if h>Steps { h = Steps }
+		if h*4>len(rest) { h = len(rest)/4 }
+		for i := 0 ; i<h ; i++ { sp = append(sp,binary.BigEndian.Uint32(rest[i*4:])) }
+		n.Spans,rest = sp,rest[h*4:]
+	}
+	
+	n.Comparator = ""
+	if flags&hasComparator!=0 && len(rest)>=1 {
+		l := int(rest[0])
+		rest = rest[1:]
+		if l>len(rest) { l = len(rest) }
+		n.Comparator = string(rest[:l])
+	}
 	n.Tainted = false
 }
 func (n *Node) Store(buf *bytebufferpool.ByteBuffer) {
 	n.Head.Rest = int32(len(n.Key))
-	binary.Write(buf,binary.BigEndian,n.Head)
-	buf.Write(n.Key)
+	if n.hasValue() { n.Head.Rest |= hasValue }
+	if n.Spans!=nil { n.Head.Rest |= hasSpans }
+	if n.Comparator!="" { n.Head.Rest |= hasComparator }
+	l := len(buf.B)
+	buf.B = append(buf.B,make([]byte,HeadSize)...)
+	n.Head.encode(buf.B[l:])
+	buf.B = append(buf.B,n.Key...)
+	if n.hasValue() {
+		var vl [4]byte
+		if n.Overflow!=0 {
+			binary.BigEndian.PutUint32(vl[:],uint32(n.Overflow)|overflow)
+			buf.B = append(buf.B,vl[:]...)
+		} else {
+			binary.BigEndian.PutUint32(vl[:],uint32(len(n.Value)))
+			buf.B = append(append(buf.B,vl[:]...),n.Value...)
+		}
+	}
+	if n.Spans!=nil {
+		buf.B = append(buf.B,byte(len(n.Spans)))
+		for _,w := range n.Spans { buf.B = binary.BigEndian.AppendUint32(buf.B,w) }
+	}
+	if n.Comparator!="" {
+		buf.B = append(append(buf.B,byte(len(n.Comparator))),n.Comparator...)
+	}
 	n.Tainted = false
 }
+// Stores the node without schema prefix, if it has no value, spans or comparator (see version 1).
+func (n *Node) StoreLegacy(buf *bytebufferpool.ByteBuffer) bool {
+	if n.hasValue() || n.Spans!=nil || n.Comparator!="" { return false }
+	n.Store(buf)
+	return true
+}
 func (n *Node) Dirty() bool { return n.Tainted }
 
 // This object must be used with care - otherwise the Skiplist becomes out of order.
 type KeySearcher struct{
-	Cache *genericstruct.NodeCache
+	Cache *NodeCache
 	Ptrs  [Steps]int64
 	Jumps [Steps]int
+	
+	// The positions of Ptrs (the head being 0), if the list is indexed. Set by Steps().
+	Ranks [Steps]int64
+	
+	// The comparator of the list, set by Steps() and StepsFind().
+	cmp   Comparator
+	indexed bool
+}
+func (k *KeySearcher) compare(a, b []byte) int {
+	if k.cmp==nil { k.cmp = LookupComparator("") }
+	return k.cmp(a,b)
+}
+func (k *KeySearcher) comparePair(n *Node, key []byte, value int64) int {
+	num := k.compare(n.Key,key)
+	if num!=0 { return num }
+	switch {
+	case n.Head.Content<value: return -1
+	case n.Head.Content>value: return 1
+	}
+	return 0
 }
 func (k *KeySearcher) Steps(off int64, key []byte) error {
-	b,err := k.Cache.Get(off)
+	return k.StepsPair(off,key,math.MinInt64)
+}
+/*
+Like Steps, but searches for the position of (key,value), ordering the nodes by their key
+and then by their value. Used for lists with duplicate keys (see MultiMap).
+*/
+func (k *KeySearcher) StepsPair(off int64, key []byte, value int64) error {
+	node,err := k.Cache.Get(off)
 	if err!=nil { return err }
-	node := b.(*Node)
+	k.cmp,err = node.comparator()
+	if err!=nil { return err }
+	k.indexed = node.Spans!=nil
 	for idx := range k.Jumps { k.Jumps[idx] = 0 }
 	i := Steps-1
+	pos := int64(0)
 	k.Ptrs[i] = off
+	k.Ranks[i] = pos
 	for {
 		next := node.Head.Nexts[i]
 		
 		// While next node is NULL, do:
 		for next==0 && 0<i {
 			// Try again with lower Level
-			k.Ptrs[i-1] = k.Ptrs[i]
+			k.Ptrs[i-1],k.Ranks[i-1] = k.Ptrs[i],pos
 			i--
 			next = node.Head.Nexts[i]
 		}
 		if next==0 { break }
 		
-		nb,err := k.Cache.Get(next)
+		nnode,err := k.Cache.Get(next)
 		if err!=nil { return err }
-		nnode := nb.(*Node)
-		num := bytes.Compare(nnode.Key,key)
+		num := k.comparePair(nnode,key,value)
 		
 		// if nnode.Key < key, then:
 		if num<0 {
 			// Skip to next element.
-			k.Ptrs[i] = next
+			pos += node.span(i)
+			k.Ptrs[i],k.Ranks[i] = next,pos
 			node = nnode
 			k.Jumps[i]++
 			continue
@@ -104,7 +316,7 @@ func (k *KeySearcher) Steps(off int64, key []byte) error {
 		// if key <= nnode.Key, then:
 		if 0<=num && 0<i {
 			// Try again with lower Level
-			k.Ptrs[i-1] = k.Ptrs[i]
+			k.Ptrs[i-1],k.Ranks[i-1] = k.Ptrs[i],pos
 			i--
 			continue
 		}
@@ -115,7 +327,7 @@ func (k *KeySearcher) Steps(off int64, key []byte) error {
 	
 	// Fill the all the Levels.
 	for 0<i {
-		k.Ptrs[i-1] = k.Ptrs[i]
+		k.Ptrs[i-1],k.Ranks[i-1] = k.Ptrs[i],pos
 		i--
 	}
 	return nil
@@ -123,9 +335,10 @@ func (k *KeySearcher) Steps(off int64, key []byte) error {
 
 // Fast path towards finding.
 func (k *KeySearcher) StepsFind(off int64, key []byte) (int64,*Node,error) {
-	b,err := k.Cache.Get(off)
+	node,err := k.Cache.Get(off)
+	if err!=nil { return 0,nil,err }
+	k.cmp,err = node.comparator()
 	if err!=nil { return 0,nil,err }
-	node := b.(*Node)
 	for idx := range k.Jumps { k.Jumps[idx] = 0 }
 	i := Steps-1
 	k.Ptrs[i] = off
@@ -141,10 +354,9 @@ func (k *KeySearcher) StepsFind(off int64, key []byte) (int64,*Node,error) {
 		}
 		if next==0 { break }
 		
-		nb,err := k.Cache.Get(next)
+		nnode,err := k.Cache.Get(next)
 		if err!=nil { return 0,nil,err }
-		nnode := nb.(*Node)
-		num := bytes.Compare(nnode.Key,key)
+		num := k.compare(nnode.Key,key)
 		
 		// if nnode.Key < key, then:
 		if num<0 {
@@ -156,7 +368,7 @@ func (k *KeySearcher) StepsFind(off int64, key []byte) (int64,*Node,error) {
 		}
 		// if nnode.Key == key, then return immediately.
 		if num==0 {
-			return next,node,nil
+			return next,nnode,nil
 		}
 		
 		// if key <= nnode.Key, then:
@@ -175,16 +387,14 @@ func (k *KeySearcher) StepsFind(off int64, key []byte) (int64,*Node,error) {
 
 
 func (k *KeySearcher) foundRef(key []byte) (it int64,it2 *Node,ok bool,err error) {
-	b,e := k.Cache.Get(k.Ptrs[0])
+	node,e := k.Cache.Get(k.Ptrs[0])
 	if e!=nil { err = e; return }
-	node := b.(*Node)
 	nxt := node.Head.Nexts[0]
 	if nxt==0 { return }
-	b,e = k.Cache.Get(nxt)
+	node,e = k.Cache.Get(nxt)
 	if e!=nil { err = e; return }
-	node = b.(*Node)
 	
-	num := bytes.Compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
+	num := k.compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
 	if num!=0 { return }
 	it  = nxt
 	it2 = node
@@ -193,16 +403,14 @@ func (k *KeySearcher) foundRef(key []byte) (it int64,it2 *Node,ok bool,err error
 }
 
 func (k *KeySearcher) FoundNode(key []byte) (it *Node,ok bool,err error) {
-	b,e := k.Cache.Get(k.Ptrs[0])
+	node,e := k.Cache.Get(k.Ptrs[0])
 	if e!=nil { err = e; return }
-	node := b.(*Node)
 	nxt := node.Head.Nexts[0]
 	if nxt==0 { return }
-	b,e = k.Cache.Get(nxt)
+	node,e = k.Cache.Get(nxt)
 	if e!=nil { err = e; return }
-	node = b.(*Node)
 	
-	num := bytes.Compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
+	num := k.compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
 	if num!=0 { return }
 	it = node
 	ok = true
@@ -210,16 +418,14 @@ func (k *KeySearcher) FoundNode(key []byte) (it *Node,ok bool,err error) {
 }
 
 func (k *KeySearcher) Found(key []byte) (it int64,ok bool,err error) {
-	b,e := k.Cache.Get(k.Ptrs[0])
+	node,e := k.Cache.Get(k.Ptrs[0])
 	if e!=nil { err = e; return }
-	node := b.(*Node)
 	nxt := node.Head.Nexts[0]
 	if nxt==0 { return }
-	b,e = k.Cache.Get(nxt)
+	node,e = k.Cache.Get(nxt)
 	if e!=nil { err = e; return }
-	node = b.(*Node)
 	
-	num := bytes.Compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
+	num := k.compare(node.Key,key)  // num = node.Key-key : node.Key<key = num<0
 	if num!=0 { return }
 	it = node.Head.Content
 	ok = true
@@ -238,31 +444,53 @@ and k.Found() was checked with the same key, that this one doesn't exist
 	if !ok { k.Insert(KEY,VALUE,level) }
 */
 func (k *KeySearcher) Insert(key []byte, value int64, level int) (int64,error) {
+	return k.insert(&Node{Key:key,Head:NodeHead{Content:value}},level)
+}
+func (k *KeySearcher) insert(n *Node, level int) (int64,error) {
 	if level<0 || level>=Steps { panic("level out of range") }
-	noff,err := k.Cache.Set(&Node{Key:key,Head:NodeHead{Content:value}})
-	if err!=nil { return 0,err }
-	
-	rn,err := k.Cache.Get(noff)
+	if k.indexed { n.Spans = make([]uint32,level+1) }
+	noff,err := k.Cache.Set(n)
 	if err!=nil { return 0,err }
-	node := rn.(*Node)
+	return noff,k.link(noff,level)
+}
+// Links the node noff, that has been written with the given level, after the k.Ptrs.
+func (k *KeySearcher) link(noff int64, level int) error {
+	node,err := k.Cache.Pin(noff)
+	if err!=nil { return err }
+	defer k.Cache.Unpin(noff)
 	node.Tainted = true
 	
 	// This loop will link at any requested level.
 	i := level
 	for {
-		rpt,err := k.Cache.Get(k.Ptrs[i])
-		if err!=nil { return 0,err }
-		pt := rpt.(*Node)
+		pt,err := k.Cache.Pin(k.Ptrs[i])
+		if err!=nil { return err }
 		
 		node.Head.Nexts[i] = pt.Head.Nexts[i]
+		if k.indexed && node.Head.Nexts[i]!=0 {
+			node.Spans[i] = uint32(k.Ranks[i]+pt.span(i)-k.Ranks[0])
+		}
 		
 		pt.Head.Nexts[i] = noff
+		if k.indexed { pt.Spans[i] = uint32(k.Ranks[0]+1-k.Ranks[i]) }
 		pt.Tainted = true
+		k.Cache.Unpin(k.Ptrs[i])
 		
 		if i==0 { break }
 		i--
 	}
-	return noff,nil
+	
+	// The links above the node skip one more node now.
+	for i = level+1 ; k.indexed && i<Steps ; i++ {
+		pt,err := k.Cache.Pin(k.Ptrs[i])
+		if err!=nil { return err }
+		if pt.Head.Nexts[i]!=0 {
+			pt.Spans[i]++
+			pt.Tainted = true
+		}
+		k.Cache.Unpin(k.Ptrs[i])
+	}
+	return nil
 }
 
 
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "github.com/maxymania/gobase/dataman"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "encoding/binary"
+import "os"
+import "reflect"
+import "testing"
+
+func tempFile(t testing.TB) *os.File {
+	f,err := os.CreateTemp(t.TempDir(),"skiplist")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func newDataManager(t testing.TB) (*dataman.SimpleDataManager,*NodeCache) {
+	dm,err := dataman.NewSimpleDataManager(tempFile(t))
+	if err!=nil { t.Fatal(err) }
+	return dm,NodeMaster.Open(dm,false)
+}
+func newCache(t testing.TB) *NodeCache {
+	_,nc := newDataManager(t)
+	return nc
+}
+
+// The reflection-based codec, that Node replaced. It only supports version 1 nodes.
+func refLoad(n *Node, buf *bytebufferpool.ByteBuffer) {
+	src := bytes.NewReader(buf.B)
+	binary.Read(src,binary.BigEndian,&(n.Head))
+	n.Key = make([]byte,int(n.Head.Rest))
+	src.Read(n.Key)
+}
+func refStore(n *Node, buf *bytebufferpool.ByteBuffer) {
+	n.Head.Rest = int32(len(n.Key))
+	binary.Write(buf,binary.BigEndian,n.Head)
+	buf.Write(n.Key)
+}
+
+func testNode() *Node {
+	n := &Node{Key:[]byte("some key")}
+	for i := range n.Head.Nexts { n.Head.Nexts[i] = int64(i)*4096+16 }
+	n.Head.Content = -42
+	return n
+}
+
+func roundTrip(n *Node) *Node {
+	buf := new(bytebufferpool.ByteBuffer)
+	n.Store(buf)
+	m := NodeConstructor()
+	m.Load(buf)
+	return m
+}
+
+func TestNodeRoundTrip(t *testing.T) {
+	nodes := []*Node{testNode(),testNode(),testNode(),testNode(),testNode(),testNode()}
+	nodes[1].Value = []byte("value")
+	nodes[2].Value = []byte{}
+	nodes[3].Overflow,nodes[3].Head.Content = 1<<20,1234
+	nodes[4].Value,nodes[4].Spans = []byte("v"),[]uint32{1,3,7}
+	nodes[5].Spans,nodes[5].Comparator = []uint32{2},Int64
+	for i,n := range nodes {
+		m := roundTrip(n)
+		if !reflect.DeepEqual(m,n) { t.Fatalf("node %d: got %+v, want %+v",i,m,n) }
+	}
+}
+
+// Version 1 nodes are encoded exactly like the reflection-based codec did.
+func TestNodeWireFormat(t *testing.T) {
+	n := testNode()
+	a,b := new(bytebufferpool.ByteBuffer),new(bytebufferpool.ByteBuffer)
+	n.Store(a)
+	refStore(n,b)
+	if !bytes.Equal(a.B,b.B) { t.Fatal("the encoding differs from binary.Write") }
+	m := NodeConstructor()
+	refLoad(m,a)
+	if !reflect.DeepEqual(m,n) { t.Fatalf("binary.Read got %+v",m) }
+}
+
+// A truncated key is zero-padded to its stored length.
+func TestNodeTruncated(t *testing.T) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	buf.B = buf.B[:len(buf.B)-3]
+	n := NodeConstructor()
+	n.Load(buf)
+	if !bytes.Equal(n.Key,[]byte("some \x00\x00\x00")) { t.Fatalf("got %q",n.Key) }
+	
+	buf.B = buf.B[:HeadSize-1]
+	n.Load(buf)
+	if n.Head!=(NodeHead{}) || len(n.Key)!=0 { t.Fatalf("truncated head decoded as %+v",n) }
+}
+
+// Loading into a used node reuses its storage.
+func TestNodeReuse(t *testing.T) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	n := NodeConstructor()
+	n.Load(buf)
+	if allocs := testing.AllocsPerRun(100,func() { n.Load(buf) }) ; allocs!=0 { t.Fatalf("%v allocations per reload",allocs) }
+}
+
+func BenchmarkNodeLoad(b *testing.B) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { NodeConstructor().Load(buf) }
+}
+func BenchmarkNodeLoadReflect(b *testing.B) {
+	buf := new(bytebufferpool.ByteBuffer)
+	testNode().Store(buf)
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { refLoad(NodeConstructor(),buf) }
+}
+func BenchmarkNodeStore(b *testing.B) {
+	buf,n := new(bytebufferpool.ByteBuffer),testNode()
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { buf.Reset(); n.Store(buf) }
+}
+func BenchmarkNodeStoreReflect(b *testing.B) {
+	buf,n := new(bytebufferpool.ByteBuffer),testNode()
+	b.ReportAllocs()
+	for i := 0 ; i<b.N ; i++ { buf.Reset(); refStore(n,buf) }
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "encoding/binary"
+import "errors"
+import "time"
+
+var EBadDeadline = errors.New("EBadDeadline")
+
+/*
+A skiplist with expiring keys. The deadline of an entry (in Unix nanoseconds, 0 for none)
+is stored as 8 byte value section of its node, so that a lookup needs no additional read.
+Expired entries are treated as absent, until SweepExpired() deletes them. Iterators over
+Head return them too; Range() filters them out.
+
+The second list, Deadlines, indexes the entries by [ Deadline:8 | Key ] (the deadline
+with the sign bit flipped), so that sweeping finds expired entries without scanning.
+Both lists must only be modified through TTLList.
+*/
+type TTLList struct{
+	Cache     *NodeCache
+	Head      int64
+	Deadlines int64
+	
+	// The time source. Nil means time.Now.
+	Clock     func() time.Time
+}
+
+// Creates an empty TTLList, whose keys are ordered by the named comparator.
+func CreateTTLList(nc *NodeCache, cmp string) (*TTLList,error) {
+	l,err := CreateList(nc,cmp)
+	if err!=nil { return nil,err }
+	d,err := CreateList(nc,Bytewise)
+	if err!=nil { return nil,err }
+	return &TTLList{Cache:nc,Head:l.Head,Deadlines:d.Head},nil
+}
+func OpenTTLList(nc *NodeCache, head, deadlines int64, cmp string) (*TTLList,error) {
+	_,err := OpenList(nc,head,cmp)
+	if err!=nil { return nil,err }
+	_,err = OpenList(nc,deadlines,Bytewise)
+	if err!=nil { return nil,err }
+	return &TTLList{Cache:nc,Head:head,Deadlines:deadlines},nil
+}
+
+func (t *TTLList) now() int64 {
+	if t.Clock==nil { return time.Now().UnixNano() }
+	return t.Clock().UnixNano()
+}
+func deadline(n *Node) int64 {
+	if n.Overflow!=0 || len(n.Value)!=8 { return 0 }
+	return int64(binary.BigEndian.Uint64(n.Value))
+}
+func deadlineKey(dl int64, key []byte) []byte {
+	k := make([]byte,8,8+len(key))
+	binary.BigEndian.PutUint64(k,uint64(dl)^(1<<63))
+	return append(k,key...)
+}
+func expired(dl, now int64) bool { return dl!=0 && dl<=now }
+
+// Sets the value and deadline of n.
+func setDeadline(n *Node, value int64, dl int64) {
+	if len(n.Value)!=8 { n.Value = make([]byte,8) }
+	binary.BigEndian.PutUint64(n.Value,uint64(dl))
+	n.Overflow = 0
+	n.Head.Content = value
+}
+
+// Returns the value of the key, unless it doesn't exist or has expired.
+func (t *TTLList) Get(key []byte) (int64,bool,error) {
+	node,ok,err := LookupNode(t.Cache,t.Head,key)
+	if !ok || expired(deadline(node),t.now()) { return 0,false,err }
+	return node.Head.Content,true,nil
+}
+// Returns the deadline of the key (the zero Time, if it never expires).
+func (t *TTLList) Deadline(key []byte) (time.Time,bool,error) {
+	node,ok,err := LookupNode(t.Cache,t.Head,key)
+	if !ok || expired(deadline(node),t.now()) { return time.Time{},false,err }
+	dl := deadline(node)
+	if dl==0 { return time.Time{},true,nil }
+	return time.Unix(0,dl),true,nil
+}
+// Reports, whether the node (e.g. from an Iterator over Head) has not expired.
+func (t *TTLList) Alive(n *Node) bool { return !expired(deadline(n),t.now()) }
+
+// An Iterator over the entries in [start,end), that haven't expired. A nil start or end means unbounded.
+func (t *TTLList) Range(start, end []byte) *Iterator {
+	it := NewRangeIterator(t.Cache,t.Head,start,end)
+	it.filter = t.Alive
+	return it
+}
+
+/*
+Inserts the key or replaces its value. The entry expires after ttl; if ttl<=0, it never expires.
+*/
+func (t *TTLList) Put(key []byte, value int64, ttl time.Duration) error {
+	nc := t.Cache
+	dl := int64(0)
+	if ttl>0 { dl = t.now()+int64(ttl) }
+	ks := KeySearcher{Cache:nc}
+	err := ks.Steps(t.Head,key)
+	if err!=nil { return err }
+	ref,node,ok,err := ks.foundRef(key)
+	if err!=nil { return err }
+	
+	if ok {
+		// The deadline index uses the stored key, which may differ from key (see NoCase).
+		key = append([]byte(nil),node.Key...)
+		if old := deadline(node) ; old!=0 {
+			_,err = Delete(nc,t.Deadlines,deadlineKey(old,key))
+			if err!=nil { return err }
+		}
+		if section(node)==12 {
+			node,err = nc.Pin(ref)
+			if err!=nil { return err }
+			setDeadline(node,value,dl)
+			node.Tainted = true
+			nc.Unpin(ref)
+		} else {
+			// The node has no room for the deadline: Replace it.
+			n := &Node{Key:key}
+			setDeadline(n,value,dl)
+			err = ks.replace(ref,n)
+			if err!=nil { return err }
+		}
+	} else {
+		n := &Node{Key:key}
+		setDeadline(n,value,dl)
+		_,err = ks.insert(n,randomLevel())
+		if err!=nil { return err }
+	}
+	if dl==0 { return nil }
+	return InsertionAlgorithmV1(nc,t.Deadlines,deadlineKey(dl,key),0)
+}
+
+// Deletes the key. Returns false, if it doesn't exist or has expired (it is deleted anyway).
+func (t *TTLList) Delete(key []byte) (bool,error) {
+	ks := KeySearcher{Cache:t.Cache}
+	err := ks.Steps(t.Head,key)
+	if err!=nil { return false,err }
+	ref,node,ok,err := ks.foundRef(key)
+	if !ok { return false,err }
+	dl := deadline(node)
+	dkey := deadlineKey(dl,node.Key)
+	err = ks.remove(ref,node)
+	if err!=nil { return false,err }
+	if dl!=0 {
+		_,err = Delete(t.Cache,t.Deadlines,dkey)
+	}
+	return !expired(dl,t.now()),err
+}
+
+/*
+Deletes up to budget expired entries, in deadline order. Returns the number of deleted
+entries; if it equals budget, there may be more. Index entries, whose entry has been
+deleted or has got another deadline, are dropped without being counted.
+*/
+func (t *TTLList) SweepExpired(budget int) (int,error) {
+	nc := t.Cache
+	now := t.now()
+	n := 0
+	for n<budget {
+		head,err := nc.Get(t.Deadlines)
+		if err!=nil { return n,err }
+		ref := head.Head.Nexts[0]
+		if ref==0 { break }
+		first,err := nc.Get(ref)
+		if err!=nil { return n,err }
+		if len(first.Key)<8 { return n,EBadDeadline }
+		dl := int64(binary.BigEndian.Uint64(first.Key)^(1<<63))
+		if !expired(dl,now) { break }
+		dkey := append([]byte(nil),first.Key...)
+		
+		_,_,err = ConsumeFirstIfLowerOrEqual(nc,t.Deadlines,dkey)
+		if err!=nil { return n,err }
+		key := dkey[8:]
+		node,ok,err := LookupNode(nc,t.Head,key)
+		if err!=nil { return n,err }
+		if !ok || deadline(node)!=dl { continue }
+		ok,err = Delete(nc,t.Head,key)
+		if err!=nil { return n,err }
+		if ok { n++ }
+	}
+	return n,nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "testing"
+import "time"
+
+// A TTLList with a manual clock, starting at the Unix epoch plus one second.
+func newTTL(t *testing.T, cmp string) (*TTLList,*time.Time) {
+	l,err := CreateTTLList(newCache(t),cmp)
+	if err!=nil { t.Fatal(err) }
+	now := time.Unix(1,0)
+	l.Clock = func() time.Time { return now }
+	return l,&now
+}
+
+// The number of entries in the deadline index.
+func deadlines(t *testing.T, l *TTLList) int {
+	it := NewIterator(l.Cache,l.Deadlines)
+	n := 0
+	for ok := it.SeekFirst() ; ok ; ok = it.Next() { n++ }
+	it.Close()
+	if it.Err()!=nil { t.Fatal(it.Err()) }
+	return n
+}
+
+func TestTTL(t *testing.T) {
+	l,now := newTTL(t,Bytewise)
+	for i,ttl := range []time.Duration{time.Second,0,3*time.Second,time.Second} {
+		if err := l.Put([]byte{'a'+byte(i)},int64(i),ttl) ; err!=nil { t.Fatal(err) }
+	}
+	if v,ok,err := l.Get([]byte("a")) ; v!=0 || !ok || err!=nil { t.Fatal("Get",v,ok,err) }
+	if dl,ok,err := l.Deadline([]byte("c")) ; !ok || err!=nil || !dl.Equal(now.Add(3*time.Second)) { t.Fatal("Deadline",dl,ok,err) }
+	if dl,ok,err := l.Deadline([]byte("b")) ; !ok || err!=nil || !dl.IsZero() { t.Fatal("Deadline without expiry",dl,ok,err) }
+	
+	*now = now.Add(2*time.Second)
+	if _,ok,err := l.Get([]byte("a")) ; ok || err!=nil { t.Fatal("Get of an expired key",ok,err) }
+	if got := collect(t,l.Range(nil,nil)) ; !equal(got,[]int64{1,2}) { t.Fatalf("Range got %v",got) }
+	if got := collect(t,NewIterator(l.Cache,l.Head)) ; len(got)!=4 { t.Fatalf("an Iterator over Head got %v",got) }
+	if ok,err := l.Delete([]byte("d")) ; ok || err!=nil { t.Fatal("Delete of an expired key",ok,err) }
+	
+	if n,err := l.SweepExpired(10) ; n!=1 || err!=nil { t.Fatal("SweepExpired",n,err) }
+	if got := collect(t,NewIterator(l.Cache,l.Head)) ; !equal(got,[]int64{1,2}) { t.Fatalf("got %v after sweeping",got) }
+	if n := deadlines(t,l) ; n!=1 { t.Fatalf("%d deadline entries, expected 1",n) }
+}
+
+// Replacing the deadline of a key removes the old index entry, even if the key differs in case.
+func TestTTLReplace(t *testing.T) {
+	l,now := newTTL(t,NoCase)
+	if err := l.Put([]byte("Key"),1,time.Second) ; err!=nil { t.Fatal(err) }
+	if err := l.Put([]byte("KEY"),2,3*time.Second) ; err!=nil { t.Fatal(err) }
+	if n := deadlines(t,l) ; n!=1 { t.Fatalf("%d deadline entries, expected 1",n) }
+	
+	*now = now.Add(2*time.Second)
+	if n,err := l.SweepExpired(10) ; n!=0 || err!=nil { t.Fatal("SweepExpired",n,err) }
+	if v,ok,err := l.Get([]byte("key")) ; v!=2 || !ok || err!=nil { t.Fatal("Get",v,ok,err) }
+	if ok,err := l.Delete([]byte("kEY")) ; !ok || err!=nil { t.Fatal("Delete",ok,err) }
+	if n := deadlines(t,l) ; n!=0 { t.Fatalf("%d deadline entries after Delete",n) }
+}
+
+// SweepExpired deletes in bounded batches, and only counts deleted entries.
+func TestSweepExpired(t *testing.T) {
+	l,now := newTTL(t,Int64)
+	for i := int64(0) ; i<10 ; i++ {
+		if err := l.Put(Int64Key(i),i,time.Duration(i+1)*time.Second) ; err!=nil { t.Fatal(err) }
+	}
+	*now = now.Add(5*time.Second) // 0..4 have expired
+	if n,err := l.SweepExpired(3) ; n!=3 || err!=nil { t.Fatal("SweepExpired",n,err) }
+	if n,err := l.SweepExpired(3) ; n!=2 || err!=nil { t.Fatal("SweepExpired",n,err) }
+	if n,err := l.SweepExpired(3) ; n!=0 || err!=nil { t.Fatal("SweepExpired of nothing",n,err) }
+	if got := collect(t,NewIterator(l.Cache,l.Head)) ; !equal(got,[]int64{5,6,7,8,9}) { t.Fatalf("got %v",got) }
+}
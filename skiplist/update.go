@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package skiplist
+
+import "errors"
+
+/*
+Returned by Update, Upsert and CompareAndSwap for nodes with a value section (KV and TTL
+lists), whose Head.Content is managed by the list.
+*/
+var EValueNode = errors.New("EValueNode")
+
+/*
+Sets the value of the node ref, if check (nil means any) accepts its current value.
+Returns the previous value and whether it has been replaced.
+*/
+func (k *KeySearcher) set(ref int64, check func(int64) bool, value int64) (int64,bool,error) {
+	node,err := k.Cache.Pin(ref)
+	if err!=nil { return 0,false,err }
+	defer k.Cache.Unpin(ref)
+	if node.hasValue() { return 0,false,EValueNode }
+	old := node.Head.Content
+	if check!=nil && !check(old) { return old,false,nil }
+	if old!=value {
+		node.Head.Content = value
+		node.Tainted = true
+	}
+	return old,true,nil
+}
+
+/*
+Replaces the value of an existing key. Returns false, if the key doesn't exist.
+
+Update, Upsert and CompareAndSwap read and modify the list without locking. Like all other
+modifications, the caller must serialize them, e.g. by holding a lock for the list.
+*/
+func Update(nc *NodeCache,off int64,key []byte, value int64) (bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,_,err := ks.StepsFind(off,key)
+	if err!=nil || ref==0 { return false,err }
+	_,ok,err := ks.set(ref,nil,value)
+	return ok,err
+}
+
+// Inserts the key or replaces its value. If it existed, it returns the previous value.
+func Upsert(nc *NodeCache,off int64,key []byte, value int64) (old int64,existed bool,err error) {
+	ks := KeySearcher{Cache:nc}
+	err = ks.Steps(off,key)
+	if err!=nil { return }
+	ref,_,ok,err := ks.foundRef(key)
+	if err!=nil { return }
+	if ok {
+		old,existed,err = ks.set(ref,nil,value)
+		return
+	}
+	_,err = ks.Insert(key,value,randomLevel())
+	return
+}
+
+/*
+Replaces the value of the key with new, if it is currently old.
+Returns false, if the key doesn't exist or has a different value.
+*/
+func CompareAndSwap(nc *NodeCache,off int64,key []byte, old, new int64) (bool,error) {
+	ks := KeySearcher{Cache:nc}
+	ref,_,err := ks.StepsFind(off,key)
+	if err!=nil || ref==0 { return false,err }
+	_,ok,err := ks.set(ref,func(v int64) bool { return v==old },new)
+	return ok,err
+}
@@ -0,0 +1,55 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package skiplist
+
+import "testing"
+
+func TestUpdate(t *testing.T) {
+	l := intList(t,newCache(t),10)
+	key := Int64Key(3)
+	if ok,err := Update(l.Cache,l.Head,key,30) ; !ok || err!=nil { t.Fatal("Update",ok,err) }
+	if ok,err := Update(l.Cache,l.Head,Int64Key(10),1) ; ok || err!=nil { t.Fatal("Update of a missing key",ok,err) }
+	if old,existed,err := Upsert(l.Cache,l.Head,key,31) ; old!=30 || !existed || err!=nil { t.Fatal("Upsert",old,existed,err) }
+	if _,existed,err := Upsert(l.Cache,l.Head,Int64Key(10),100) ; existed || err!=nil { t.Fatal("Upsert of a new key",existed,err) }
+	if ok,err := CompareAndSwap(l.Cache,l.Head,key,30,32) ; ok || err!=nil { t.Fatal("CompareAndSwap with a wrong old value",ok,err) }
+	if ok,err := CompareAndSwap(l.Cache,l.Head,key,31,32) ; !ok || err!=nil { t.Fatal("CompareAndSwap",ok,err) }
+	for k,v := range map[int64]int64{ 3:32, 10:100, 4:4 } {
+		if got,ok,err := l.Lookup(Int64Key(k)) ; got!=v || !ok || err!=nil { t.Fatalf("%d: expected %d, got %d %v %v",k,v,got,ok,err) }
+	}
+}
+
+// Lists with a value section manage Head.Content themselves.
+func TestUpdateValueNode(t *testing.T) {
+	l,err := CreateList(newCache(t),Bytewise)
+	if err!=nil { t.Fatal(err) }
+	if err = l.KV().Put([]byte("kv"),[]byte("value")) ; err!=nil { t.Fatal(err) }
+	ttl := &TTLList{Cache:l.Cache,Head:l.Head}
+	if err = ttl.Put([]byte("ttl"),5,0) ; err!=nil { t.Fatal(err) }
+	for _,key := range []string{"kv","ttl"} {
+		if _,err = Update(l.Cache,l.Head,[]byte(key),1) ; err!=EValueNode { t.Fatal("Update",key,err) }
+		if _,_,err = Upsert(l.Cache,l.Head,[]byte(key),1) ; err!=EValueNode { t.Fatal("Upsert",key,err) }
+		if _,err = CompareAndSwap(l.Cache,l.Head,[]byte(key),0,1) ; err!=EValueNode { t.Fatal("CompareAndSwap",key,err) }
+	}
+	if v,_,_ := l.KV().Get([]byte("kv")) ; string(v)!="value" { t.Fatalf("KV value changed to %q",v) }
+}